@@ -3,7 +3,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
 	"testing"
+
+	"github.com/urfave/cli/v3"
 )
 
 var tests = []struct {
@@ -56,3 +62,78 @@ func BenchmarkIsValidHexChatGPT(b *testing.B) {
 		}
 	}
 } */
+
+// Checks the subcommand names seen by the root command before running them, whatever
+// flags come in between, and which of them are offline.
+func TestSubcommandName(t *testing.T) {
+	var got string
+	noop := func(ctx context.Context, cmd *cli.Command) error { return nil }
+	root := &cli.Command{
+		Name:  "tinify-go",
+		Flags: []cli.Flag{&cli.StringFlag{Name: "profile"}},
+		Before: func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+			got = subcommandName(cmd)
+			return ctx, nil
+		},
+		Commands: []*cli.Command{
+			{Name: "compress", Action: noop},
+			{Name: "git", Flags: []cli.Flag{&cli.BoolFlag{Name: "staged"}}, Action: noop, Commands: []*cli.Command{
+				{Name: "install-hook", Action: noop},
+			}},
+			{Name: "config", Commands: []*cli.Command{{Name: "show", Action: noop}}},
+		},
+	}
+	var nameTests = []struct {
+		args    []string
+		want    string
+		offline bool
+	}{
+		{[]string{"compress", "install-hook"}, "compress", false},
+		{[]string{"--profile", "work", "compress"}, "compress", false},
+		{[]string{"git"}, "git", false},
+		{[]string{"git", "install-hook"}, "git install-hook", true},
+		{[]string{"git", "--staged", "install-hook"}, "git install-hook", true},
+		{[]string{"--profile", "work", "config", "show"}, "config show", true},
+	}
+	for _, tc := range nameTests {
+		got = ""
+		if err := root.Run(context.Background(), append([]string{"tinify-go"}, tc.args...)); err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want || isOfflineCommand(got) != tc.offline {
+			t.Fatalf("%q: got %q (offline is %t), expected %q (offline is %t)", tc.args, got, isOfflineCommand(got), tc.want, tc.offline)
+		}
+	}
+}
+
+// Checks that AVIF images are recognised by the brands on their ftyp box, which
+// http.DetectContentType does not look at, and that other images are still detected.
+func TestDetectMediaType(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	var mediaTypeTests = []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"AVIF", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf\x00\x00\x00\x08mdat"), "image/avif"},
+		{"AVIF sequence", []byte("\x00\x00\x00\x18ftypavis\x00\x00\x00\x00avismsf1"), "image/avif"},
+		{"AVIF as a compatible brand", []byte("\x00\x00\x00\x1cftypmif1\x00\x00\x00\x00mif1avifmiaf"), "image/avif"},
+		{"HEIC", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), "application/octet-stream"},
+		{"brand past the ftyp box", []byte("\x00\x00\x00\x10ftypmif1\x00\x00\x00\x00avif"), "application/octet-stream"},
+		{"AVIF as the minor version", []byte("\x00\x00\x00\x14ftypmif1avifmif1"), "application/octet-stream"},
+		{"PNG", buf.Bytes(), "image/png"},
+		{"too short", []byte("\x00\x00\x00\x0cftypavif"), "application/octet-stream"},
+	}
+	for _, tc := range mediaTypeTests {
+		got := detectMediaType(tc.data)
+		if got != tc.want {
+			t.Fatalf("%s: detected %q, expected %q", tc.name, got, tc.want)
+		}
+		if supported := tc.want != "application/octet-stream"; isSupportedMediaType(got) != supported {
+			t.Fatalf("%s: %q is supported is %t, expected %t", tc.name, got, !supported, supported)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Automatic background colours: `--background auto` picks a solid colour from the
+// image itself, so that transparent pixels blend with whatever surrounds them.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg" // registers the decoders used by image.Decode.
+	_ "image/png"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Value of --background which asks for the colour to be picked from the image.
+const autoBackground = "auto"
+
+// More than this share of the opaque pixels sampled must have (roughly) the same colour
+// for it to be the dominant one; otherwise, they get averaged.
+const dominantShare = 0.5
+
+// chosenBackground is the colour picked for the current image, so that it's only
+// worked out (and reported) once, even if it's used for several variants.
+var chosenBackground string
+
+// colourSum adds up the colours of some pixels, to average them.
+type colourSum struct{ r, g, b, n uint64 }
+
+// hex returns the average colour as "#rrggbb".
+func (s *colourSum) hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", (s.r+s.n/2)/s.n, (s.g+s.n/2)/s.n, (s.b+s.n/2)/s.n)
+}
+
+// colourSampler groups opaque pixels into buckets of similar colours (4 bits per
+// channel), so that JPEG noise and gentle gradients still count as the same colour;
+// pixels which are not fully opaque are ignored.
+type colourSampler struct {
+	buckets map[uint32]*colourSum
+	total   colourSum
+}
+
+// add samples one pixel.
+func (c *colourSampler) add(colour color.Color) {
+	r, g, b, a := colour.RGBA()
+	if a != 0xffff {
+		return
+	}
+	if c.buckets == nil {
+		c.buckets = make(map[uint32]*colourSum)
+	}
+	key := (r>>12)<<8 | (g>>12)<<4 | b>>12
+	s, ok := c.buckets[key]
+	if !ok {
+		s = new(colourSum)
+		c.buckets[key] = s
+	}
+	for _, t := range []*colourSum{s, &c.total} {
+		t.r += uint64(r >> 8)
+		t.g += uint64(g >> 8)
+		t.b += uint64(b >> 8)
+		t.n++
+	}
+}
+
+// pick returns the average colour of the largest bucket, if it has more than
+// dominantShare of the samples, or else the average of all of them, and whether
+// it was the former. With no samples, the colour is empty.
+func (c *colourSampler) pick() (colour string, dominant bool) {
+	if c.total.n == 0 {
+		return "", false
+	}
+	var largest *colourSum
+	for _, s := range c.buckets {
+		if largest == nil || s.n > largest.n {
+			largest = s
+		}
+	}
+	if float64(largest.n) > dominantShare*float64(c.total.n) {
+		return largest.hex(), true
+	}
+	return c.total.hex(), false
+}
+
+// detectBackground looks at the edges of the image, returning the colour that most of
+// their opaque pixels share, or else their average colour, as "#rrggbb", together with
+// how it was found. If no pixel on the edges is opaque (e.g. a cut-out product shot),
+// it returns an empty colour, since there is nothing to blend with.
+func detectBackground(data []byte) (colour string, how string, err error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", "", err
+	}
+	bounds := img.Bounds()
+	var edges colourSampler
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		edges.add(img.At(x, bounds.Min.Y))
+		if bounds.Dy() > 1 {
+			edges.add(img.At(x, bounds.Max.Y-1))
+		}
+	}
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
+		edges.add(img.At(bounds.Min.X, y))
+		if bounds.Dx() > 1 {
+			edges.add(img.At(bounds.Max.X-1, y))
+		}
+	}
+	colour, dominant := edges.pick()
+	switch {
+	case len(colour) == 0:
+		return "", "", nil
+	case dominant:
+		return colour, "dominant edge colour", nil
+	}
+	return colour, "average edge colour", nil
+}
+
+// parseColour converts a background colour ("white", "black", or a hex value, as
+// checked by isValidBackground) into RGB; the alpha of 8-digit values is ignored.
+func parseColour(s string) color.NRGBA {
+	switch s {
+	case "white":
+		return color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	case "black":
+		return color.NRGBA{0, 0, 0, 0xff}
+	}
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	var rgb [3]uint8
+	for i := range rgb {
+		if len(s) >= 2*i+2 {
+			v, _ := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+			rgb[i] = uint8(v)
+		}
+	}
+	return color.NRGBA{rgb[0], rgb[1], rgb[2], 0xff}
+}
+
+// resolveBackground returns the background to be used for the current image: the one
+// given with --background, unless that's "auto", in which case it's picked from the
+// edges of the original image, or else --page-colour. The colour is reported, and
+// added to the current record.
+func resolveBackground(s *Setting) (string, error) {
+	if s.Transform != autoBackground {
+		return s.Transform, nil
+	}
+	if len(chosenBackground) > 0 {
+		return chosenBackground, nil
+	}
+	colour, how := "", ""
+	if originalImage != nil {
+		var err error
+		if colour, how, err = detectBackground(originalImage); err != nil {
+			// E.g. AVIF, which cannot be decoded.
+			setting.Logger.Warn().Msgf("resolveBackground: cannot pick a background from %q: %s", s.ImageName, err)
+		}
+	}
+	if len(colour) == 0 {
+		colour, how = s.PageColour, "page colour"
+	}
+	if colour != "white" && colour != "black" && !isValidHex(colour) {
+		return "", fmt.Errorf("resolveBackground: invalid background colour %q", colour)
+	}
+	setting.Logger.Info().Msgf("resolveBackground: %q: using %s as background (%s)", s.ImageName, colour, how)
+	chosenBackground = colour
+	if current != nil {
+		current.Background = colour
+	}
+	return colour, nil
+}
@@ -0,0 +1,65 @@
+// Tests for automatic background colours.
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// Checks the background colour picked from the edges of an image: the dominant one,
+// the average, or none if the edges are transparent.
+func TestDetectBackground(t *testing.T) {
+	// A 10×10 image with a transparent middle, and edges painted by paint.
+	edged := func(paint func(x, y int) color.NRGBA) []byte {
+		img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		for y := range 10 {
+			for x := range 10 {
+				if x == 0 || y == 0 || x == 9 || y == 9 {
+					img.SetNRGBA(x, y, paint(x, y))
+				}
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var backgroundTests = []struct {
+		name string
+		data []byte
+		want string
+		how  string
+	}{
+		{"solid edges", edged(func(x, y int) color.NRGBA { return color.NRGBA{0xff, 0, 0, 0xff} }), "#ff0000", "dominant edge colour"},
+		{"mostly one colour", edged(func(x, y int) color.NRGBA {
+			if x == 0 {
+				return color.NRGBA{0, 0, 0xff, 0xff}
+			}
+			return color.NRGBA{0x20, 0x40, 0x60, 0xff}
+		}), "#204060", "dominant edge colour"},
+		{"two halves", edged(func(x, y int) color.NRGBA {
+			if x < 5 {
+				return color.NRGBA{0, 0, 0, 0xff}
+			}
+			return color.NRGBA{0xff, 0xff, 0xff, 0xff}
+		}), "#808080", "average edge colour"},
+		{"transparent edges", edged(func(x, y int) color.NRGBA { return color.NRGBA{} }), "", ""},
+	}
+	for _, tc := range backgroundTests {
+		colour, how, err := detectBackground(tc.data)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if colour != tc.want || how != tc.how {
+			t.Fatalf("%s: got %q (%s), expected %q (%s)", tc.name, colour, how, tc.want, tc.how)
+		}
+		if len(colour) > 0 && !isValidHex(colour) {
+			t.Fatalf("%s: %q is not a valid hex colour", tc.name, colour)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Configuration files and named profiles.
+//
+// Settings may come from a project file (tinify.toml or .tinify.json, on the current
+// directory or any of its parents) and from a user file ($XDG_CONFIG_HOME/tinify-go/config),
+// in either TOML or JSON. Both may contain named profiles, e.g. [profiles.blog], whose
+// values override the top-level ones. Precedence is: flags > environment > project file > user file.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v3"
+)
+
+// Project configuration filenames, in order of preference.
+var projectConfigNames = []string{"tinify.toml", ".tinify.json"}
+
+// configFile holds the contents of one configuration file.
+type configFile struct {
+	path     string                    // Where it was read from.
+	values   map[string]any            // Top-level values.
+	profiles map[string]map[string]any // Named profiles.
+	presets  map[string]any            // Resize presets, either specifications or tables.
+}
+
+// Both configuration files are only read once, when first needed.
+var config struct {
+	once    sync.Once
+	project *configFile // nil if there is none.
+	user    *configFile // nil if there is none.
+	err     error       // Whatever went wrong while reading them.
+}
+
+// loadConfig reads the project and user configuration files, if they exist.
+func loadConfig() {
+	config.once.Do(func() {
+		if path := findProjectConfig(); len(path) > 0 {
+			config.project, config.err = readConfigFile(path)
+			if config.err != nil {
+				return
+			}
+		}
+		if dir, err := os.UserConfigDir(); err == nil {
+			path := filepath.Join(dir, "tinify-go", "config")
+			if _, err := os.Stat(path); err == nil {
+				config.user, config.err = readConfigFile(path)
+			}
+		}
+	})
+}
+
+// findProjectConfig looks for a project configuration file on the current
+// directory, and then on each of its parents.
+func findProjectConfig() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		for _, name := range projectConfigNames {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readConfigFile parses a configuration file, which may be either TOML or JSON.
+func readConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]any)
+	if strings.HasSuffix(path, ".json") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = json.Unmarshal(data, &raw)
+	} else {
+		err = toml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: cannot parse %q: %w", path, err)
+	}
+
+	cf := &configFile{
+		path:     path,
+		values:   normaliseConfigKeys(raw),
+		profiles: make(map[string]map[string]any),
+	}
+	if profiles, ok := raw["profiles"].(map[string]any); ok {
+		for name, values := range profiles {
+			if values, ok := values.(map[string]any); ok {
+				cf.profiles[name] = normaliseConfigKeys(values)
+			}
+		}
+		delete(cf.values, "profiles")
+	}
+	if presets, ok := raw["presets"].(map[string]any); ok {
+		cf.presets = presets
+		delete(cf.values, "presets")
+	}
+	return cf, nil
+}
+
+// normaliseConfigKeys allows keys to be written either as the flag names
+// (e.g. output-template) or with underscores (output_template).
+func normaliseConfigKeys(values map[string]any) map[string]any {
+	normalised := make(map[string]any, len(values))
+	for key, value := range values {
+		normalised[strings.ReplaceAll(key, "_", "-")] = value
+	}
+	return normalised
+}
+
+// lookup returns a value from the configuration file, preferring the one on the
+// current profile, if there is one; values are converted to strings, which is
+// what the CLI flags expect.
+func (cf *configFile) lookup(key string) (string, bool) {
+	if cf == nil {
+		return "", false
+	}
+	value, ok := cf.profiles[setting.Profile][key]
+	if !ok {
+		value, ok = cf.values[key]
+	}
+	if !ok {
+		return "", false
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []any:
+		// Lists, e.g. of file types, become comma-separated.
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ","), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// configValueSource allows a configuration file to be used as a source for CLI flags.
+type configValueSource struct {
+	key  string // Key on the configuration file.
+	user bool   // If set, use the user file; otherwise, the project file.
+}
+
+// Lookup satisfies the cli.ValueSource interface.
+func (cvs *configValueSource) Lookup() (string, bool) {
+	return cvs.file().lookup(cvs.key)
+}
+
+// String satisfies the fmt.Stringer interface, and is used on the help text.
+func (cvs *configValueSource) String() string {
+	kind := "project"
+	if cvs.user {
+		kind = "user"
+	}
+	if cf := cvs.file(); cf != nil {
+		if _, ok := cf.profiles[setting.Profile][cvs.key]; ok {
+			return fmt.Sprintf("%s file %q (profile %q)", kind, cf.path, setting.Profile)
+		}
+		return fmt.Sprintf("%s file %q", kind, cf.path)
+	}
+	return kind + " file"
+}
+
+// GoString satisfies the fmt.GoStringer interface.
+func (cvs *configValueSource) GoString() string {
+	return fmt.Sprintf("&configValueSource{key:%q,user:%t}", cvs.key, cvs.user)
+}
+
+// file returns the configuration file for this source, reading it if needed.
+func (cvs *configValueSource) file() *configFile {
+	loadConfig()
+	if cvs.user {
+		return config.user
+	}
+	return config.project
+}
+
+// configSources returns the chain of sources for a flag, in order of precedence:
+// environment variables (if any), project file, and user file.
+func configSources(key string, envVars ...string) cli.ValueSourceChain {
+	chain := cli.EnvVars(envVars...)
+	chain.Chain = append(chain.Chain,
+		&configValueSource{key: key},
+		&configValueSource{key: key, user: true},
+	)
+	return chain
+}
+
+// argsValueSource looks up a global flag on the command line arguments, wherever it was
+// given. Global flags get their values from the other sources before the subcommand
+// parses its own flags, so a flag given after the subcommand would be known too late.
+type argsValueSource struct {
+	names []string // Flag names, without dashes.
+	args  []string // Command line arguments, without the program name.
+}
+
+// Lookup satisfies the cli.ValueSource interface. If the flag is given more than once,
+// the last value wins, as it does when parsing.
+func (avs *argsValueSource) Lookup() (value string, found bool) {
+	for i := 0; i < len(avs.args); i++ {
+		arg := avs.args[i]
+		if arg == "--" {
+			break
+		}
+		for _, name := range avs.names {
+			for _, flag := range []string{"-" + name, "--" + name} {
+				switch {
+				case arg == flag && i+1 < len(avs.args):
+					i++
+					value, found = avs.args[i], true
+				case strings.HasPrefix(arg, flag+"="):
+					value, found = arg[len(flag)+1:], true
+				}
+			}
+		}
+	}
+	return value, found
+}
+
+// String satisfies the fmt.Stringer interface, and is used on the help text.
+func (avs *argsValueSource) String() string {
+	return "command line"
+}
+
+// GoString satisfies the fmt.GoStringer interface.
+func (avs *argsValueSource) GoString() string {
+	return fmt.Sprintf("&argsValueSource{names:%q}", avs.names)
+}
+
+// profileSources returns the chain of sources for --profile: the flag itself, given
+// anywhere on args, so that the profile is known before any other flag is looked up on
+// the configuration files; and then the environment.
+func profileSources(args []string) cli.ValueSourceChain {
+	chain := cli.NewValueSourceChain(&argsValueSource{names: []string{"profile", "p"}, args: args})
+	chain.Chain = append(chain.Chain, cli.EnvVars("TINIFY_PROFILE").Chain...)
+	return chain
+}
+
+// checkProfile makes sure that the selected profile exists on at least one of the files.
+func checkProfile() error {
+	loadConfig()
+	if config.err != nil {
+		return config.err
+	}
+	if len(setting.Profile) == 0 {
+		return nil
+	}
+	for _, cf := range []*configFile{config.project, config.user} {
+		if cf != nil {
+			if _, ok := cf.profiles[setting.Profile]; ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("config: profile %q not found", setting.Profile)
+}
+
+// configKey describes a setting which can be read from the configuration files.
+type configKey struct {
+	key     string   // Key on the configuration files, which is also the flag name.
+	envVars []string // Environment variables, if any.
+	secret  bool     // If set, only the last few characters are shown.
+}
+
+// All settings that can be read from the configuration files.
+var configKeys = []configKey{
+	{key: "key", envVars: []string{"TINIFY_API_KEY"}, secret: true},
+	{key: "proxy"},
+	{key: "method"},
+	{key: "width"},
+	{key: "height"},
+	{key: "type"},
+	{key: "background"},
+	{key: "output-template"},
+	{key: "concurrency"},
+	{key: "sizes"},
+	{key: "lazy"},
+	{key: "url-prefix"},
+	{key: "ledger"},
+	{key: "mark"},
+	{key: "verify-key"},
+	{key: "summary"},
+	{key: "min-savings"},
+	{key: "min-savings-bytes"},
+	{key: "min-ssim"},
+	{key: "low-quality"},
+	{key: "jpeg-background"},
+	{key: "page-colour"},
+	{key: "placeholder"},
+	{key: "placeholder-size"},
+	{key: "preset"},
+}
+
+// configShow is the action for `config show`. It prints all settings which may come from
+// the configuration files, with their resolved values, and where those came from.
+func configShow(ctx context.Context, cmd *cli.Command) error {
+	if err := checkProfile(); err != nil {
+		return err
+	}
+	loadConfig()
+	for _, name := range []string{"project", "user"} {
+		cf := config.project
+		if name == "user" {
+			cf = config.user
+		}
+		if cf == nil {
+			fmt.Printf("%s file: (none)\n", name)
+			continue
+		}
+		fmt.Printf("%s file: %s\n", name, cf.path)
+	}
+	if len(setting.Profile) > 0 {
+		fmt.Printf("profile: %s\n", setting.Profile)
+	}
+	fmt.Println()
+
+	// Keys may be longer than expected, so the columns are aligned as needed.
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, ck := range configKeys {
+		var (
+			value  string
+			source string
+		)
+		chain := configSources(ck.key, ck.envVars...)
+		v, src, found := chain.LookupWithSource()
+		// Only global flags can have been set on the command line here; note that
+		// flags also count as set when their value comes from one of the sources.
+		flagValue := fmt.Sprint(cmd.Root().Value(ck.key))
+		switch {
+		case cmd.Root().IsSet(ck.key) && (!found || flagValue != v):
+			value, source = flagValue, "command line"
+		case found:
+			value, source = v, src.String()
+		default:
+			value, source = configDefault(cmd, ck.key), "default"
+		}
+		if ck.secret && len(value) > 4 {
+			value = "[..." + value[len(value)-4:] + "]"
+		}
+		fmt.Fprintf(w, "%s\t%q\t%s\n", ck.key, value, source)
+	}
+	return w.Flush()
+}
+
+// configDefault returns the default value of a flag, looking it up on all commands.
+// The typed value is used, since its documentation string has quotes around strings.
+func configDefault(cmd *cli.Command, name string) string {
+	commands := append([]*cli.Command{cmd.Root()}, cmd.Root().Commands...)
+	for _, c := range commands {
+		for _, f := range c.Flags {
+			if slices.Contains(f.Names(), name) {
+				return fmt.Sprint(f.Get())
+			}
+		}
+	}
+	return ""
+}
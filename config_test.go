@@ -0,0 +1,110 @@
+// Tests for configuration files and profiles.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Checks that values from a profile override the top-level ones, and that
+// keys may use either dashes or underscores.
+func TestConfigFileLookup(t *testing.T) {
+	saved := setting
+	defer func() { setting = saved }()
+	path := filepath.Join(t.TempDir(), "tinify.toml")
+	data := "method = \"fit\"\nwidth = 800\ntype = [\"webp\", \"avif\"]\n\n[profiles.blog]\nwidth = 1200\noutput_template = \"{name}.{ext}\"\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lookupTests = []struct {
+		profile  string
+		key      string
+		expected string
+		found    bool
+	}{
+		{"", "method", "fit", true},
+		{"", "width", "800", true},
+		{"", "type", "webp,avif", true},
+		{"", "output-template", "", false},
+		{"blog", "width", "1200", true},
+		{"blog", "method", "fit", true},
+		{"blog", "output-template", "{name}.{ext}", true},
+		{"other", "width", "800", true},
+	}
+
+	for _, tc := range lookupTests {
+		setting.Profile = tc.profile
+		if got, found := cf.lookup(tc.key); got != tc.expected || found != tc.found {
+			t.Fatalf("looked up %q on profile %q and got (%q, %t), expected (%q, %t)", tc.key, tc.profile, got, found, tc.expected, tc.found)
+		}
+	}
+}
+
+// Checks that a profile selected after the subcommand applies to the global flags too,
+// whose values are looked up on the configuration files before the subcommand runs.
+func TestProfileAfterSubcommand(t *testing.T) {
+	saved := setting
+	defer func() { setting = saved }()
+	path := filepath.Join(t.TempDir(), "tinify.toml")
+	data := "output-template = \"{name}.top.{ext}\"\n\n[profiles.blog]\noutput-template = \"{name}.blog.{ext}\"\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadConfig()
+	savedProject, savedUser := config.project, config.user
+	defer func() { config.project, config.user = savedProject, savedUser }()
+	config.project, config.user = cf, nil
+
+	var profileTests = []struct {
+		args     []string
+		template string
+		source   string
+	}{
+		{[]string{"config", "show", "--profile", "blog"}, "{name}.blog.{ext}", `project file "` + path + `" (profile "blog")`},
+		{[]string{"--profile", "blog", "config", "show"}, "{name}.blog.{ext}", `project file "` + path + `" (profile "blog")`},
+		{[]string{"config", "show", "-p=blog"}, "{name}.blog.{ext}", `project file "` + path + `" (profile "blog")`},
+		{[]string{"config", "show"}, "{name}.top.{ext}", `project file "` + path + `"`},
+		{[]string{"config", "show", "--", "--profile", "blog"}, "{name}.top.{ext}", `project file "` + path + `"`},
+	}
+	for _, tc := range profileTests {
+		setting = saved
+		root := &cli.Command{
+			Name: "tinify-go",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "profile", Aliases: []string{"p"}, Sources: profileSources(tc.args), Destination: &setting.Profile},
+				&cli.StringFlag{Name: "output-template", Sources: configSources("output-template"), Destination: &setting.OutputTemplate},
+			},
+			Commands: []*cli.Command{
+				{Name: "config", Commands: []*cli.Command{{Name: "show", Action: configShow}}},
+			},
+		}
+		var err error
+		output := captureStdout(t, func() {
+			err = root.Run(context.Background(), append([]string{"tinify-go"}, tc.args...))
+		})
+		if err != nil {
+			t.Fatalf("%q: %s", tc.args, err)
+		}
+		if setting.OutputTemplate != tc.template {
+			t.Fatalf("%q: output template is %q, expected %q", tc.args, setting.OutputTemplate, tc.template)
+		}
+		if want := fmt.Sprintf("%q", tc.template); !strings.Contains(output, want+"  "+tc.source+"\n") {
+			t.Fatalf("%q: config show printed:\n%s\nexpected %s from %s", tc.args, output, want, tc.source)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Git integration: runs the images which were added or modified through the API,
+// in place, and stages them again, e.g. from a pre-commit hook.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Hooks written by `git install-hook` include this line, so that they can be
+// told apart from hooks written by someone else.
+const gitHookSignature = "# Installed by tinify-go."
+
+// gitImages is the action for the `git` command.
+func gitImages(ctx context.Context, cmd *cli.Command) error {
+	if setting.GitStaged && len(setting.GitSince) > 0 {
+		return fmt.Errorf("git: --staged and --since cannot be used together")
+	}
+	if setting.Operation == "convert" {
+		return fmt.Errorf("git: cannot convert images in place, since their file type would change")
+	}
+	if err := checkOperation(setting.Operation, &setting); err != nil {
+		return err
+	}
+
+	root, err := runGit(ctx, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	top := strings.TrimSpace(string(root))
+
+	// Either the staged files, or whatever changed since the given revision
+	// (including uncommitted changes).
+	args := []string{"diff", "--name-status", "-z", "--diff-filter=AMR"}
+	if len(setting.GitSince) > 0 {
+		args = append(args, setting.GitSince)
+	} else {
+		args = append(args, "--cached")
+	}
+	out, err := runGit(ctx, args...)
+	if err != nil {
+		return err
+	}
+	var images []string
+	for _, name := range changedFiles(out) {
+		if slices.Contains(watchExtensions, strings.ToLower(filepath.Ext(name))) {
+			images = append(images, filepath.Join(top, filepath.FromSlash(name)))
+		}
+	}
+	if len(images) == 0 {
+		setting.Logger.Info().Msg("git: no added or modified images")
+		return nil
+	}
+
+	// Staging them again would also stage whatever changes were left unstaged,
+	// which were certainly not meant to be committed together.
+	if out, err = runGit(ctx, append([]string{"diff", "--name-only", "-z", "--"}, images...)...); err != nil {
+		return err
+	}
+	if unstaged := strings.Split(strings.TrimRight(string(out), "\x00"), "\x00"); len(unstaged[0]) > 0 {
+		return fmt.Errorf("git: refusing to run, since these images have unstaged changes (stage or stash them first): %s", strings.Join(unstaged, ", "))
+	}
+
+	defer printReports()
+
+	var (
+		processed []string // images which were actually changed.
+		failed    int
+	)
+	for _, image := range images {
+		if _, err := os.Stat(image); err != nil {
+			// Changed since the revision, but deleted from the working tree afterwards.
+			continue
+		}
+		setting.ImageName, setting.OutputFileName = image, image
+		setting.Logger.Info().Msgf("git: processing %q", image)
+		changed, err := gitProcess(ctx, cmd)
+		endRecord(err)
+		if err != nil && !errors.Is(err, errDryRun) && !isSkipped(err) {
+			setting.Logger.Error().Msgf("git: processing %q failed: %s", image, err)
+			failed++
+			continue
+		}
+		if changed {
+			processed = append(processed, image)
+		}
+	}
+
+	if len(processed) > 0 {
+		if _, err = runGit(ctx, append([]string{"add", "--"}, processed...)...); err != nil {
+			return err
+		}
+		setting.Logger.Info().Msgf("git: %d image(s) processed and staged", len(processed))
+	}
+	if failed > 0 {
+		// Most likely from a hook, so that the commit gets aborted.
+		return fmt.Errorf("git: %d of %d image(s) could not be processed", failed, len(images))
+	}
+	return nil
+}
+
+// changedFiles returns the files which were added or modified, from the output of
+// `git diff --name-status -z`, i.e. a status followed by one path, or by two for renames
+// and copies. Files which were just renamed (with a similarity of 100%) are left out,
+// since their contents are as they were.
+func changedFiles(out []byte) []string {
+	var names []string
+	fields := strings.Split(strings.TrimRight(string(out), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, name := fields[i], fields[i+1]
+		if strings.HasPrefix(status, "R") || strings.HasPrefix(status, "C") {
+			if i += 1; i+1 >= len(fields) {
+				break
+			}
+			name = fields[i+1]
+			if status[1:] == "100" {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// gitProcess runs the current image through the API, overwriting it, and
+// reports whether it was changed.
+func gitProcess(ctx context.Context, cmd *cli.Command) (bool, error) {
+	ctx, source, err := openStream(ctx)
+	if err != nil {
+		return false, err
+	}
+	if err = applyOperation(source, setting.Operation, &setting, originalImage); err != nil {
+		return false, err
+	}
+	if err = callAPI(ctx, cmd, source); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// gitInstallHook is the action for `git install-hook`. It writes a pre-commit hook which
+// runs `git --staged` with the same operation; an existing hook is only replaced if it was
+// written by us, or with --force.
+func gitInstallHook(ctx context.Context, cmd *cli.Command) error {
+	out, err := runGit(ctx, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return err
+	}
+	hooks := strings.TrimSpace(string(out))
+	hook := filepath.Join(hooks, "pre-commit")
+
+	existing, err := os.ReadFile(hook)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	case !bytes.Contains(existing, []byte(gitHookSignature)) && !setting.Force:
+		return fmt.Errorf("git: %q already exists, and was not written by tinify-go; use --force to replace it", hook)
+	}
+
+	// The hook calls this very same executable, if we can figure out where it is.
+	executable, err := os.Executable()
+	if err != nil {
+		executable = "tinify-go"
+	}
+	args := []string{shellQuote(executable), "git", "--staged", "--operation", setting.Operation}
+	switch setting.Operation {
+	case "resize":
+		args = append(args, "--method", setting.Method)
+		if setting.Width > 0 {
+			args = append(args, "--width", fmt.Sprint(setting.Width))
+		}
+		if setting.Height > 0 {
+			args = append(args, "--height", fmt.Sprint(setting.Height))
+		}
+	case "transform":
+		args = append(args, "--background", shellQuote(setting.Transform))
+	}
+	script := fmt.Sprintf("#!/bin/sh\n%s\n# Runs the staged images through the Tinify API before each commit.\nexec %s\n",
+		gitHookSignature, strings.Join(args, " "))
+
+	if err = os.MkdirAll(hooks, 0755); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(hook, []byte(script)); err != nil {
+		return err
+	}
+	if err = os.Chmod(hook, 0755); err != nil {
+		return err
+	}
+	fmt.Printf("pre-commit hook installed on %s\n", hook)
+	return nil
+}
+
+// runGit runs git with the given arguments, returning its output; errors include
+// whatever git wrote to STDERR.
+func runGit(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	c := exec.CommandContext(ctx, "git", args...)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// shellQuote quotes a string for the shell, if needed.
+func shellQuote(s string) string {
+	if len(s) > 0 && strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:", r)
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
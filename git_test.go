@@ -0,0 +1,118 @@
+// Tests for the git integration.
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Checks that arguments are quoted for the shell only when needed.
+func TestShellQuote(t *testing.T) {
+	var quoteTests = []struct {
+		s, want string
+	}{
+		{"/usr/local/bin/tinify-go", "/usr/local/bin/tinify-go"},
+		{"#ffffff", "'#ffffff'"},
+		{"/home/me/my apps/tinify-go", "'/home/me/my apps/tinify-go'"},
+		{"it's", `'it'\''s'`},
+		{"", "''"},
+	}
+
+	for _, tc := range quoteTests {
+		if got := shellQuote(tc.s); got != tc.want {
+			t.Fatalf("quoted %q and got %q, expected %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+// Checks, on a temporary repository, that just the staged images which were added,
+// modified, or renamed with changes are run through a fake API, and staged again.
+func TestGitImages(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	saved, savedLedger := setting, activeLedger
+	defer func() { setting, activeLedger, current, records, summaryRecords = saved, savedLedger, nil, nil, nil }()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Chdir(dir)
+	api := useFakeAPI(t)
+
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := runGit(context.Background(), append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	// Large enough for git to tell that an image was renamed, even if it was changed a little.
+	encode := func(shade uint8) []byte {
+		img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i*7) ^ shade
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	write := func(name string, data []byte) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	for i, name := range []string{"modified.png", "renamed.png", "moved.png", "deleted.png", "unchanged.png"} {
+		write(name, encode(uint8(i)))
+	}
+	write("notes.txt", []byte("notes"))
+	git("add", ".")
+	git("commit", "-q", "-m", "images")
+
+	write("added.png", encode(10))
+	write("modified.png", encode(11))
+	write("notes.txt", []byte("more notes"))
+	git("mv", "renamed.png", "renamed-and-changed.png")
+	changed, _ := os.ReadFile(filepath.Join(dir, "renamed-and-changed.png"))
+	write("renamed-and-changed.png", append(changed, "trailing"...))
+	git("mv", "moved.png", "just-moved.png")
+	git("rm", "-q", "deleted.png")
+	git("add", ".")
+
+	setting.Operation, setting.GitStaged, setting.GitSince, setting.Mark = "compress", true, "", true
+	setting.DryRun, setting.Force, setting.OutputFormat, setting.SummaryFormat = false, false, "", "none"
+	setting.OutputTemplate, setting.MinSavings, setting.MinSSIM = "", 0, 0
+	activeLedger = nil
+	if err := gitImages(context.Background(), &cli.Command{Name: "git"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"added.png", "modified.png", "renamed-and-changed.png"}
+	if api.Uploads() != len(want) {
+		t.Fatalf("%d image(s) uploaded, expected %d", api.Uploads(), len(want))
+	}
+	// Nothing was left unstaged, and whatever was processed carries our marker on the index.
+	if unstaged := git("diff", "--name-only"); len(unstaged) > 0 {
+		t.Fatalf("left unstaged: %q", unstaged)
+	}
+	for _, name := range []string{"added.png", "modified.png", "renamed-and-changed.png", "just-moved.png", "unchanged.png"} {
+		_, marked := findMarker([]byte(git("show", ":"+name)))
+		if marked != slices.Contains(want, name) {
+			t.Fatalf("%s: marked is %t on the index", name, marked)
+		}
+	}
+}
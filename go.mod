@@ -3,10 +3,13 @@ module github.com/gwpp/tinify-go
 go 1.24.6
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/GwynethLlewelyn/justify v0.2.1
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/joho/godotenv v1.5.1
 	github.com/rs/zerolog v1.34.0
 	github.com/urfave/cli/v3 v3.6.1
+	golang.org/x/image v0.36.0
 	golang.org/x/term v0.37.0
 )
 
@@ -0,0 +1,41 @@
+// Helpers shared by the tests of the command-line tool.
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/gwpp/tinify-go/tinify/tinifytest"
+)
+
+// captureStdout returns whatever f writes to STDOUT.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	f()
+	w.Close()
+	return string(<-done)
+}
+
+// useFakeAPI makes the client call a fake API for the rest of the test.
+func useFakeAPI(t *testing.T) *tinifytest.API {
+	t.Helper()
+	api := &tinifytest.API{}
+	Tinify.SetKey("test")
+	Tinify.GetClient().SetTransport(api)
+	t.Cleanup(func() { Tinify.GetClient().SetTransport(nil) })
+	return api
+}
@@ -0,0 +1,234 @@
+// Favicons and app icons: the usual sizes from a single upload, plus favicon.ico,
+// a web app manifest, and the <link> elements to put on every page.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+)
+
+// Sizes of the icons embedded in favicon.ico, if they were requested.
+var icoSizes = []int64{16, 32, 48}
+
+// Names of the files written by the icons command, besides the icons themselves.
+const (
+	icoFileName         = "favicon.ico"
+	webManifestFileName = "site.webmanifest"
+)
+
+// webManifestIcon is one of the icons listed on the web app manifest.
+type webManifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+// webManifest is the web app manifest (https://www.w3.org/TR/appmanifest/), with
+// just what browsers need to use the icons.
+type webManifest struct {
+	Name             string            `json:"name"`
+	ShortName        string            `json:"short_name"`
+	Icons            []webManifestIcon `json:"icons"`
+	ThemeColour      string            `json:"theme_color"`
+	BackgroundColour string            `json:"background_color"`
+	Display          string            `json:"display"`
+}
+
+// iconFileName returns the conventional filename for an icon of the given size.
+func iconFileName(size int64) string {
+	switch {
+	case size == 180:
+		return "apple-touch-icon.png"
+	case size == 192 || size == 512:
+		return fmt.Sprintf("android-chrome-%dx%d.png", size, size)
+	case size <= 64:
+		return fmt.Sprintf("favicon-%dx%d.png", size, size)
+	}
+	return fmt.Sprintf("icon-%dx%d.png", size, size)
+}
+
+// icons is the action for the `icons` command.
+func icons(ctx context.Context, cmd *cli.Command) error {
+	var (
+		err    error // declared here due to scope issues.
+		source *Tinify.Source
+	)
+
+	sizes, err := parseWidths(cmd.String("sizes"))
+	if err != nil {
+		return err
+	}
+	method := strings.ToLower(cmd.String("method"))
+
+	// As with srcset, the output "filename" is actually a directory.
+	outputDir := setting.OutputFileName
+	if cmd.IsSet("out") {
+		outputDir = cmd.String("out")
+	}
+	setting.OutputFileName = ""
+	if len(outputDir) == 0 || outputDir == "-" {
+		outputDir, _, _ = splitInputName(setting.ImageName)
+	}
+	if err = os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	setting.Operation = "icons"
+	setting.Logger.Debug().Msgf("icons called, sizes %v, method %q", sizes, method)
+
+	if ctx, source, err = openStream(ctx); errors.Is(err, errDryRun) {
+		// Each icon is resized, and converted unless the original is a PNG already.
+		perIcon := int64(2)
+		if originalImage != nil && detectMediaType(originalImage) == "image/png" {
+			perIcon = 1
+		}
+		setPlanCompressions(1 + perIcon*int64(len(sizes)))
+		return nil
+	} else if isSkipped(err) {
+		return nil
+	} else if err != nil {
+		setting.Logger.Error().Msgf("icons: invalid filenames, error was %v", err)
+		return err
+	}
+
+	background := ""
+	if len(setting.Transform) > 0 {
+		if background, err = resolveBackground(&setting); err != nil {
+			return err
+		}
+	}
+	if largest := slices.Max(sizes); source.Shrink().Output.Width < largest || source.Shrink().Output.Height < largest {
+		setting.Logger.Warn().Msgf("icons: %q is only %dx%d, and will be upscaled to %dx%d",
+			setting.ImageName, source.Shrink().Output.Width, source.Shrink().Output.Height, largest, largest)
+	}
+	variants, err := source.Icons(sizes, Tinify.ResizeMethod(method), background)
+	if err != nil {
+		return err
+	}
+	if err = writeIcons(source, variants, outputDir); err != nil {
+		return err
+	}
+
+	// favicon.ico, with whatever of the small sizes we have.
+	var pngs [][]byte
+	for _, v := range variants {
+		if slices.Contains(icoSizes, v.Size) {
+			pngs = append(pngs, v.Result.Data())
+		}
+	}
+	icoPath := ""
+	if len(pngs) > 0 {
+		ico, err := Tinify.EncodeICO(pngs)
+		if err != nil {
+			return err
+		}
+		icoPath = filepath.Join(outputDir, icoFileName)
+		if err = writeFileAtomic(icoPath, ico); err != nil {
+			return err
+		}
+	}
+
+	manifestPath := filepath.Join(outputDir, webManifestFileName)
+	if err = writeWebManifest(manifestPath, cmd.String("name"), variants); err != nil {
+		return err
+	}
+
+	// Reported just like other snippets, except that it's always wanted.
+	snippet := iconLinks(icoPath, manifestPath, variants)
+	switch {
+	case current != nil && len(setting.OutputFormat) > 0:
+		current.Snippet = snippet
+	default:
+		fmt.Println(snippet)
+	}
+	setting.Logger.Info().Msgf("icons: wrote %d icon(s), %q and %q to %q", len(variants), icoFileName, webManifestFileName, outputDir)
+	return nil
+}
+
+// writeIcons writes each icon, reporting each of them. The record of the last one is
+// left open, so that it also covers the ICO and the manifest.
+func writeIcons(source *Tinify.Source, variants []Tinify.IconVariant, outputDir string) error {
+	perIcon := int64(2)
+	if source.Shrink().Input.Type == "image/png" {
+		perIcon = 1
+	}
+	err := eachOutput(len(variants), func(i int) (int64, error) {
+		v := variants[i]
+		path := filepath.Join(outputDir, iconFileName(v.Size))
+		if err := writeFileAtomic(path, outputData(v.Result)); err != nil {
+			return perIcon, err
+		}
+		setting.CompressionCount = v.Result.CompressionCount()
+		setting.Logger.Debug().Msgf("icons: wrote %q (%dx%d)", path, v.Size, v.Size)
+		resultRecord(source, v.Result, path)
+		return perIcon, nil
+	})
+	if err := saveCompressionCount(setting.CompressionCount); err != nil {
+		setting.Logger.Debug().Msgf("icons: could not save the compression count: %s", err)
+	}
+	return err
+}
+
+// writeWebManifest writes the web app manifest, listing the icons used by Android and
+// installed web apps. Icons are referred to relative to the manifest, which is where
+// they were written.
+func writeWebManifest(path, name string, variants []Tinify.IconVariant) error {
+	if len(name) == 0 {
+		_, name, _ = splitInputName(setting.ImageName)
+	}
+	colour := parseColour(setting.PageColour)
+	manifest := webManifest{
+		Name:        name,
+		ShortName:   name,
+		Icons:       []webManifestIcon{},
+		ThemeColour: fmt.Sprintf("#%02x%02x%02x", colour.R, colour.G, colour.B),
+		Display:     "standalone",
+	}
+	manifest.BackgroundColour = manifest.ThemeColour
+	for _, v := range variants {
+		if v.Size >= 192 {
+			manifest.Icons = append(manifest.Icons, webManifestIcon{
+				Src:   iconFileName(v.Size),
+				Sizes: fmt.Sprintf("%dx%d", v.Size, v.Size),
+				Type:  "image/png",
+			})
+		}
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data.Bytes())
+}
+
+// iconLinks returns the <link> elements for the icons, favicon.ico (if written) and the manifest.
+func iconLinks(icoPath, manifestPath string, variants []Tinify.IconVariant) string {
+	var links []string
+	if len(icoPath) > 0 {
+		links = append(links, fmt.Sprintf(`<link rel="icon" href="%s" sizes="any">`, html.EscapeString(snippetURL(icoPath))))
+	}
+	for _, v := range variants {
+		path := html.EscapeString(snippetURL(filepath.Join(filepath.Dir(manifestPath), iconFileName(v.Size))))
+		switch {
+		case v.Size == 180:
+			links = append(links, fmt.Sprintf(`<link rel="apple-touch-icon" sizes="180x180" href="%s">`, path))
+		case v.Size <= 64:
+			links = append(links, fmt.Sprintf(`<link rel="icon" type="image/png" sizes="%dx%d" href="%s">`, v.Size, v.Size, path))
+		}
+	}
+	links = append(links, fmt.Sprintf(`<link rel="manifest" href="%s">`, html.EscapeString(snippetURL(manifestPath))))
+	return strings.Join(links, "\n")
+}
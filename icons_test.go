@@ -0,0 +1,22 @@
+// Tests for favicons and app icons.
+package main
+
+import "testing"
+
+// Checks the conventional filenames given to icons of each size.
+func TestIconFileName(t *testing.T) {
+	var iconNameTests = []struct {
+		size int64
+		want string
+	}{
+		{16, "favicon-16x16.png"},
+		{180, "apple-touch-icon.png"},
+		{512, "android-chrome-512x512.png"},
+		{300, "icon-300x300.png"},
+	}
+	for _, tc := range iconNameTests {
+		if got := iconFileName(tc.size); got != tc.want {
+			t.Fatalf("icon of %d pixels named %q, expected %q", tc.size, got, tc.want)
+		}
+	}
+}
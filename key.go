@@ -0,0 +1,89 @@
+// API key validation: `key check`, and the optional check made with --verify-key
+// before doing any work.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+)
+
+// validateKey asks the API about the current key, remembering the compression count,
+// if one was returned.
+func validateKey(ctx context.Context) (*Tinify.KeyStatus, error) {
+	status, err := Tinify.GetClient().Validate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("key: could not validate the API key: %w", err)
+	}
+	if status.CompressionCount > 0 {
+		setting.CompressionCount = status.CompressionCount
+		if err = saveCompressionCount(status.CompressionCount); err != nil {
+			setting.Logger.Debug().Msgf("validateKey: could not save the compression count: %s", err)
+		}
+	}
+	return status, nil
+}
+
+// keyError turns an invalid key, or an account error, into an error.
+func keyError(status *Tinify.KeyStatus) error {
+	switch {
+	case !status.Valid:
+		return fmt.Errorf("invalid Tinify API key [...%s]: %s %s", keySuffix(), status.Error, status.Message)
+	case len(status.Error) > 0:
+		return fmt.Errorf("Tinify API key [...%s] cannot be used right now: %s %s", keySuffix(), status.Error, status.Message)
+	}
+	return nil
+}
+
+// verifyKey checks the key before any work is done, for --verify-key.
+func verifyKey(ctx context.Context) error {
+	status, err := validateKey(ctx)
+	if err != nil {
+		return err
+	}
+	if err = keyError(status); err != nil {
+		return err
+	}
+	setting.Logger.Debug().Msgf("verifyKey: API key [...%s] is valid; compression count is %d", keySuffix(), status.CompressionCount)
+	return nil
+}
+
+// keyCheck is the action for `key check`.
+func keyCheck(ctx context.Context, cmd *cli.Command) error {
+	setting.Operation = "key check"
+	status, err := validateKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	if setting.OutputFormat == "json" || setting.OutputFormat == "ndjson" {
+		encoder := json.NewEncoder(os.Stdout)
+		if setting.OutputFormat == "json" {
+			encoder.SetIndent("", "\t")
+		}
+		if err = encoder.Encode(status); err != nil {
+			return err
+		}
+	} else {
+		valid := "valid"
+		if !status.Valid {
+			valid = "invalid"
+		}
+		fmt.Printf("API key:           [...%s] (%s)\n", keySuffix(), valid)
+		if status.Valid {
+			fmt.Printf("Compression count: %d\n", status.CompressionCount)
+		}
+		if len(status.Error) > 0 {
+			fmt.Printf("Error:             %s %s\n", status.Error, status.Message)
+		}
+	}
+	// So that scripts can tell whether the key can be used.
+	if keyError(status) != nil {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
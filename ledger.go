@@ -0,0 +1,241 @@
+// Processing ledger: remembers what was done to each image, so that images which
+// did not change since are not sent to the API (and paid for) again.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the ledger file kept at the root of the tree, for commands which work
+// on a whole directory tree (watch, rewrite), unless --ledger is given.
+const ledgerFileName = ".tinify-go-ledger.jsonl"
+
+// ledgerEntry records what was done to one image. The ledger file has one
+// entry per line; later entries replace earlier ones.
+type ledgerEntry struct {
+	Path       string    `json:"path"`        // Absolute path of the original image.
+	InputHash  string    `json:"input_hash"`  // SHA-256 of the original image.
+	Operations string    `json:"operations"`  // Operations applied, with their parameters.
+	Output     string    `json:"output"`      // Absolute path of the processed image.
+	OutputHash string    `json:"output_hash"` // SHA-256 of the processed image.
+	Processed  time.Time `json:"processed"`   // When it was processed.
+}
+
+// ledger is the set of entries read from the ledger file, plus whatever was
+// processed since.
+type ledger struct {
+	path    string                  // Where the ledger is kept.
+	entries map[string]*ledgerEntry // Indexed by path and operations.
+	outputs map[string]string       // Hashes of all outputs, indexed by path.
+	pending *ledgerEntry            // Image being processed right now, if any.
+}
+
+// The ledger in use, if any.
+var activeLedger *ledger
+
+// skipError is returned by openStream when an image does not need to be processed.
+type skipError struct {
+	reason string // Why it was skipped.
+	output string // Existing output, if any.
+	quiet  bool   // If set, it's not even worth reporting (e.g. it's one of our own outputs).
+}
+
+// Error satisfies the error interface.
+func (e *skipError) Error() string {
+	return "skipped: " + e.reason
+}
+
+// isSkipped checks if an error just means that the image was skipped.
+func isSkipped(err error) bool {
+	var skip *skipError
+	return errors.As(err, &skip)
+}
+
+// ledgerKey returns the key for an entry on the ledger.
+func ledgerKey(path, operations string) string {
+	return path + "\x00" + operations
+}
+
+// openLedger reads the ledger at path; a missing file is not an error, since it
+// will be created on the first write.
+func openLedger(path string) (*ledger, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &ledger{
+		path:    path,
+		entries: make(map[string]*ledgerEntry),
+		outputs: make(map[string]string),
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var entry ledgerEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Most likely a line left half-written by an interrupted run.
+			setting.Logger.Warn().Msgf("ledger: ignoring line %d of %q: %s", line, path, err)
+			continue
+		}
+		l.add(&entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ledger: cannot read %q: %w", path, err)
+	}
+	setting.Logger.Debug().Msgf("ledger: %d entries read from %q", len(l.entries), path)
+	return l, nil
+}
+
+// add puts an entry on the in-memory indexes.
+func (l *ledger) add(entry *ledgerEntry) {
+	l.entries[ledgerKey(entry.Path, entry.Operations)] = entry
+	l.outputs[entry.Output] = entry.OutputHash
+}
+
+// check figures out whether the image at path, with contents data, needs to be
+// processed with the current operations, returning a *skipError if not. When it does,
+// it's remembered as pending, so that it can be added to the ledger afterwards.
+func (l *ledger) check(path string, data []byte) error {
+	l.pending = nil
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	inputHash := hashBytes(data)
+
+	// Our own outputs are never processed again (they would be on watched trees, or
+	// when processing in place).
+	if hash, ok := l.outputs[path]; ok && hash == inputHash {
+		return &skipError{reason: "already processed", output: path, quiet: true}
+	}
+
+	l.pending = &ledgerEntry{
+		Path:       path,
+		InputHash:  inputHash,
+		Operations: operationSignature(),
+	}
+	// With several outputs, it's only skipped if all of them are up to date; otherwise,
+	// those which are get skipped later, one by one (see convertEach).
+	var skip error
+	for _, operations := range outputSignatures() {
+		if skip = l.upToDate(path, inputHash, operations); skip == nil {
+			return nil
+		}
+	}
+	return skip
+}
+
+// upToDate returns a *skipError if the image at path, with the given hash, was processed
+// before with the given operations, and its output is still there; nil otherwise.
+func (l *ledger) upToDate(path, inputHash, operations string) error {
+	entry, ok := l.entries[ledgerKey(path, operations)]
+	if !ok || entry.InputHash != inputHash || setting.Force {
+		return nil
+	}
+	// With an explicit output filename, it should be the same as before.
+	if len(setting.OutputFileName) > 0 {
+		if output, err := filepath.Abs(setting.OutputFileName); err != nil || output != entry.Output {
+			return nil
+		}
+	}
+	output, err := os.ReadFile(entry.Output)
+	if err != nil {
+		// Gone, or unreadable: process it again.
+		return nil
+	}
+	if hashBytes(output) != entry.OutputHash {
+		setting.Logger.Warn().Msgf("ledger: %q was changed after being processed; leaving it alone (use --force to overwrite it)", entry.Output)
+		return &skipError{reason: "output edited since it was processed", output: entry.Output}
+	}
+	return &skipError{reason: "already processed on " + entry.Processed.Format(time.DateTime), output: entry.Output}
+}
+
+// record adds the pending image to the ledger, now that its output was written.
+func (l *ledger) record(output string, data []byte) error {
+	if l.pending == nil {
+		return nil
+	}
+	entry := l.pending
+	l.pending = nil
+
+	var err error
+	if entry.Output, err = filepath.Abs(output); err != nil {
+		return err
+	}
+	entry.OutputHash = hashBytes(data)
+	entry.Processed = time.Now()
+	return l.append(entry)
+}
+
+// append writes an entry to the ledger file, and adds it to the indexes.
+func (l *ledger) append(entry *ledgerEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Appending is cheap, and a crash can, at most, leave the last line half-written.
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	l.add(entry)
+	return nil
+}
+
+// outputSignatures returns the operation signature of each output written for an image:
+// just one, unless converting to each type on its own, in which case every type gets its
+// own entry on the ledger.
+func outputSignatures() []string {
+	if !setting.EachType || setting.Operation != "convert" {
+		return []string{operationSignature()}
+	}
+	defer func(fileType string) { setting.FileType = fileType }(setting.FileType)
+	var signatures []string
+	for fileType := range strings.SplitSeq(strings.ToLower(setting.FileType), ",") {
+		setting.FileType = fileType
+		signatures = append(signatures, operationSignature())
+	}
+	return signatures
+}
+
+// operationSignature describes the current operations, together with whatever
+// parameters affect their outcome, e.g. "resize(fit,800x600)+convert(webp)".
+func operationSignature() string {
+	ops := strings.Split(setting.Operation, "+")
+	for i, op := range ops {
+		switch op {
+		case "resize":
+			ops[i] += "(" + setting.Method + "," + strconv.FormatInt(setting.Width, 10) + "x" + strconv.FormatInt(setting.Height, 10) + ")"
+		case "convert":
+			ops[i] += "(" + setting.FileType + ")"
+		case "transform":
+			ops[i] += "(" + setting.Transform + ")"
+		}
+	}
+	return strings.Join(ops, "+")
+}
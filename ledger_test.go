@@ -0,0 +1,63 @@
+// Tests for the ledger of processed images.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Checks that the ledger skips images already processed, unless they changed, their
+// outputs were edited, or --force is given, also after being read back from disk.
+func TestLedgerCheck(t *testing.T) {
+	saved := setting
+	defer func() { setting = saved }()
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.png")
+	if err := os.WriteFile(output, []byte("tiny"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setting.Operation, setting.OutputFileName, setting.OutputTemplate, setting.Force = "compress", "", "{dir}/out.png", false
+
+	l, err := openLedger(filepath.Join(dir, ledgerFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.check(input, []byte("original")); err != nil {
+		t.Fatalf("new image was skipped: %v", err)
+	}
+	if err = l.record(output, []byte("tiny")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read it back from disk, to make sure the entry was saved.
+	if l, err = openLedger(filepath.Join(dir, ledgerFileName)); err != nil {
+		t.Fatal(err)
+	}
+	var ledgerTests = []struct {
+		path    string
+		data    string
+		skipped bool
+	}{
+		{input, "original", true},
+		{input, "changed", false},
+		{output, "tiny", true},
+	}
+	for _, tc := range ledgerTests {
+		if err = l.check(tc.path, []byte(tc.data)); isSkipped(err) != tc.skipped {
+			t.Fatalf("checked %q with %q and got %v, expected skipped to be %t", tc.path, tc.data, err, tc.skipped)
+		}
+	}
+
+	// Edited outputs are left alone.
+	if err = os.WriteFile(output, []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.check(input, []byte("original")); !isSkipped(err) {
+		t.Fatalf("edited output was not skipped, got %v", err)
+	}
+	setting.Force = true
+	if err = l.check(input, []byte("original")); err != nil {
+		t.Fatalf("--force did not reprocess, got %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+// In-band markers: a small piece of metadata embedded on each output, recording that
+// it was processed by tinify-go, so that it does not get recompressed again and
+// again as it moves around, even without the ledger.
+//
+// Each format has its own way of carrying such metadata: a tEXt chunk on PNG,
+// a COM segment on JPEG, an XMP chunk on WebP, and a uuid box on AVIF.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"slices"
+	"strings"
+	"time"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+)
+
+// Every marker starts with this.
+const markerKeyword = "tinify-go"
+
+// UUID for our own box on AVIF files (randomly generated, version 4).
+var markerUUID = []byte{
+	0x3c, 0x8e, 0x5f, 0x0d, 0x91, 0x2a, 0x4b, 0x6e,
+	0xa4, 0x17, 0x6b, 0xd2, 0x0e, 0x55, 0xc9, 0x31,
+}
+
+// XMP namespace and property used for WebP files.
+const (
+	markerXMPNamespace = "https://github.com/gwpp/tinify-go/ns/1.0/"
+	markerXMPProperty  = "tinify-go:processed"
+)
+
+// markerText returns the marker for the current operations, e.g.
+// "tinify-go; operations=resize(scale,640x0); date=2025-10-18T12:00:00Z".
+func markerText() string {
+	return fmt.Sprintf("%s; operations=%s; date=%s", markerKeyword, operationSignature(), time.Now().UTC().Format(time.RFC3339))
+}
+
+// addMarker embeds the marker on an image, according to its media type.
+func addMarker(data []byte, mediaType string) ([]byte, error) {
+	text := markerText()
+	switch mediaType {
+	case "image/png":
+		return pngAddMarker(data, text)
+	case "image/jpeg":
+		return jpegAddMarker(data, text)
+	case "image/webp":
+		return webpAddMarker(data, text)
+	case "image/avif":
+		return avifAddMarker(data, text)
+	}
+	return nil, fmt.Errorf("marker: cannot mark images of type %q", mediaType)
+}
+
+// outputData returns the data to be written for a result, with the marker, if requested.
+// Failing to add the marker is not serious enough to lose the result.
+func outputData(result *Tinify.Result) []byte {
+	data := result.Data()
+	if !setting.Mark {
+		return data
+	}
+	marked, err := addMarker(data, result.MediaType())
+	if err != nil {
+		setting.Logger.Warn().Msgf("outputData: %s", err)
+		return data
+	}
+	return marked
+}
+
+// checkMarker skips images which already have our marker, unless --force is given.
+// Since whoever asked for them may be expecting an output, the original is written there,
+// unchanged, if it's somewhere else.
+func checkMarker(data []byte) error {
+	text, found := findMarker(data)
+	if !found || setting.Force {
+		return nil
+	}
+	setting.Logger.Warn().Msgf("checkMarker: %q was already processed (%s); use --force to process it again", setting.ImageName, text)
+	skip := &skipError{reason: "already optimised: " + text}
+	if setting.DryRun {
+		return skip
+	}
+
+	// With a template, but no result, there is no way to tell where it would go.
+	if len(setting.OutputFileName) > 0 || len(setting.OutputTemplate) == 0 {
+		if err := passThrough(data, setting.OutputFileName); err != nil {
+			return err
+		}
+		skip.output = setting.OutputFileName
+	}
+	return skip
+}
+
+// findMarker looks for our marker on an image, whatever its format, and returns it.
+func findMarker(data []byte) (string, bool) {
+	var text string
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		text = pngFindMarker(data)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		text = jpegFindMarker(data)
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		text = webpFindMarker(data)
+	default:
+		text = avifFindMarker(data)
+	}
+	return text, strings.HasPrefix(text, markerKeyword)
+}
+
+// PNG files start with this signature, followed by chunks, each with length, type,
+// data and CRC; the last chunk is IEND.
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// pngAddMarker inserts a tEXt chunk right before IEND.
+func pngAddMarker(data []byte, text string) ([]byte, error) {
+	iend := -1
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if string(data[pos+4:pos+8]) == "IEND" {
+			iend = pos
+			break
+		}
+		pos += 12 + length
+	}
+	if iend < 0 {
+		return nil, fmt.Errorf("marker: invalid PNG file, no IEND chunk")
+	}
+
+	// tEXt has a keyword, a NUL separator, and the text itself.
+	payload := append([]byte("tEXt"+markerKeyword+"\x00"), text...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)-4))
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(payload))
+
+	return slices.Concat(data[:iend], chunk, data[iend:]), nil
+}
+
+// pngFindMarker returns the text of our tEXt chunk, if any.
+func pngFindMarker(data []byte) string {
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if pos+12+length > len(data) {
+			break
+		}
+		if string(data[pos+4:pos+8]) == "tEXt" {
+			if keyword, text, ok := bytes.Cut(data[pos+8:pos+8+length], []byte{0}); ok && string(keyword) == markerKeyword {
+				return string(text)
+			}
+		}
+		pos += 12 + length
+	}
+	return ""
+}
+
+// jpegAddMarker inserts a COM segment after the APPn segments (JFIF and EXIF
+// must come first), i.e., before any of the segments which describe the image.
+func jpegAddMarker(data []byte, text string) ([]byte, error) {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff && data[pos+1] >= 0xe0 && data[pos+1] <= 0xef {
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	if pos > len(data) {
+		return nil, fmt.Errorf("marker: invalid JPEG file")
+	}
+	// The length includes itself, but not the segment marker.
+	if len(text)+2 > 0xffff {
+		return nil, fmt.Errorf("marker: text too long for a JPEG comment")
+	}
+	segment := binary.BigEndian.AppendUint16([]byte{0xff, 0xfe}, uint16(len(text)+2))
+	segment = append(segment, text...)
+
+	return slices.Concat(data[:pos], segment, data[pos:]), nil
+}
+
+// jpegFindMarker returns the text of our COM segment, if any. Only the segments before
+// the image data (SOS) are searched.
+func jpegFindMarker(data []byte) string {
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xff; {
+		segmentType := data[pos+1]
+		// The length includes itself, so anything below 2 is a broken file.
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if segmentType == 0xda || length < 2 || pos+2+length > len(data) {
+			break
+		}
+		if segmentType == 0xfe && bytes.HasPrefix(data[pos+4:pos+2+length], []byte(markerKeyword)) {
+			return string(data[pos+4 : pos+2+length])
+		}
+		pos += 2 + length
+	}
+	return ""
+}
+
+// webpChunks splits a WebP file into its chunks (type and payload).
+func webpChunks(data []byte) ([][2][]byte, error) {
+	var chunks [][2][]byte
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if pos+8+size > len(data) {
+			return nil, fmt.Errorf("marker: invalid WebP file, truncated %q chunk", data[pos:pos+4])
+		}
+		chunks = append(chunks, [2][]byte{data[pos : pos+4], data[pos+8 : pos+8+size]})
+		pos += 8 + size + size%2 // chunks are padded to an even size.
+	}
+	return chunks, nil
+}
+
+// webpAddMarker adds an XMP chunk. Metadata is only allowed on the extended format,
+// so simple files (with just a VP8 or VP8L chunk) get a VP8X header as well.
+func webpAddMarker(data []byte, text string) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("marker: invalid WebP file, no chunks")
+	}
+
+	if string(chunks[0][0]) != "VP8X" {
+		width, height, alpha, err := webpDimensions(chunks[0])
+		if err != nil {
+			return nil, err
+		}
+		header := make([]byte, 10)
+		if alpha {
+			header[0] |= 0x10
+		}
+		header[4], header[5], header[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+		header[7], header[8], header[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+		chunks = append([][2][]byte{{[]byte("VP8X"), header}}, chunks...)
+	}
+	for _, chunk := range chunks {
+		if string(chunk[0]) == "XMP " {
+			return nil, fmt.Errorf("marker: WebP file already has XMP metadata")
+		}
+	}
+	// Flag the presence of XMP metadata (on a copy, not to change the original).
+	header := append([]byte{}, chunks[0][1]...)
+	header[0] |= 0x04
+	chunks[0][1] = header
+
+	xmp := fmt.Sprintf(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`+
+		`<rdf:Description rdf:about="" xmlns:tinify-go="%s" %s="%s"/></rdf:RDF></x:xmpmeta>`,
+		markerXMPNamespace, markerXMPProperty, html.EscapeString(text))
+	chunks = append(chunks, [2][]byte{[]byte("XMP "), []byte(xmp)})
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		body.Write(chunk[0])
+		body.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(chunk[1]))))
+		body.Write(chunk[1])
+		if len(chunk[1])%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(body.Len()))
+	return append(out, body.Bytes()...), nil
+}
+
+// webpDimensions reads the canvas size from a VP8 (lossy) or VP8L (lossless) chunk.
+func webpDimensions(chunk [2][]byte) (width, height int, alpha bool, err error) {
+	payload := chunk[1]
+	switch string(chunk[0]) {
+	case "VP8 ":
+		// Frame tag (3 bytes), start code (9d 01 2a), then 14-bit width and height.
+		if len(payload) < 10 || !bytes.Equal(payload[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			break
+		}
+		width = int(binary.LittleEndian.Uint16(payload[6:]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(payload[8:]) & 0x3fff)
+		return width, height, false, nil
+	case "VP8L":
+		// Signature (0x2f), then 14 bits for width-1, 14 for height-1, and the alpha bit.
+		if len(payload) < 5 || payload[0] != 0x2f {
+			break
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:])
+		width = int(bits&0x3fff) + 1
+		height = int((bits>>14)&0x3fff) + 1
+		return width, height, bits&(1<<28) != 0, nil
+	}
+	return 0, 0, false, fmt.Errorf("marker: unsupported WebP chunk %q", chunk[0])
+}
+
+// webpFindMarker returns the marker from the XMP chunk, if any.
+func webpFindMarker(data []byte) string {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return ""
+	}
+	for _, chunk := range chunks {
+		if string(chunk[0]) != "XMP " {
+			continue
+		}
+		_, value, found := bytes.Cut(chunk[1], []byte(markerXMPProperty+`="`))
+		if !found {
+			continue
+		}
+		if value, _, found = bytes.Cut(value, []byte(`"`)); found {
+			return html.UnescapeString(string(value))
+		}
+	}
+	return ""
+}
+
+// avifAddMarker appends a top-level uuid box, which readers ignore.
+func avifAddMarker(data []byte, text string) ([]byte, error) {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return nil, fmt.Errorf("marker: invalid AVIF file, no ftyp box")
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(markerUUID)+len(text)))
+	box = append(box, "uuid"...)
+	box = append(box, markerUUID...)
+	box = append(box, text...)
+	return slices.Concat(data, box), nil
+}
+
+// avifFindMarker returns the text of our uuid box, if any.
+func avifFindMarker(data []byte) string {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return ""
+	}
+	for pos := 0; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		switch size {
+		case 0:
+			// The box extends to the end of the file.
+			size = len(data) - pos
+		case 1:
+			// 64-bit size; none of our business, but it must be skipped.
+			if pos+16 > len(data) {
+				return ""
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8:]))
+		}
+		// Compared this way round, so that huge 64-bit sizes cannot overflow.
+		if size < 8 || size > len(data)-pos {
+			return ""
+		}
+		if string(data[pos+4:pos+8]) == "uuid" && size >= 24 && bytes.Equal(data[pos+8:pos+24], markerUUID) {
+			return string(data[pos+24 : pos+size])
+		}
+		pos += size
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+// Tests for the markers embedded on processed images.
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Checks that images of each format are marked as processed, recognised as such, and
+// still valid afterwards, and that broken files are never mistaken for marked ones.
+func TestMarker(t *testing.T) {
+	saved := setting
+	defer func() { setting = saved }()
+	logo, err := os.ReadFile("testdata/assets/tinify-go-logo-pangopher-128x128.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo, err := os.ReadFile("testdata/input/test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Just the headers matter here: lossless WebP (VP8L), 100x50 with alpha, and a minimal AVIF.
+	webp := []byte("RIFF\x12\x00\x00\x00WEBPVP8L\x05\x00\x00\x00\x2f\x63\x40\x0c\x10\x00")
+	avif := []byte("\x00\x00\x00\x10ftypavif\x00\x00\x00\x00\x00\x00\x00\x08mdat")
+
+	setting.Operation = "compress"
+	var markerTests = []struct {
+		mediaType string
+		data      []byte
+		decode    func(io.Reader) (image.Image, error)
+	}{
+		{"image/png", logo, png.Decode},
+		{"image/jpeg", photo, jpeg.Decode},
+		{"image/webp", webp, nil},
+		{"image/avif", avif, nil},
+	}
+	for _, tc := range markerTests {
+		if _, found := findMarker(tc.data); found {
+			t.Fatalf("%s: found a marker on an unmarked image", tc.mediaType)
+		}
+		marked, err := addMarker(tc.data, tc.mediaType)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.mediaType, err)
+		}
+		text, found := findMarker(marked)
+		if !found || !strings.Contains(text, "operations=compress") {
+			t.Fatalf("%s: marker not found, got %q", tc.mediaType, text)
+		}
+		// The marked image must still be valid.
+		if tc.decode != nil {
+			if _, err = tc.decode(bytes.NewReader(marked)); err != nil {
+				t.Fatalf("%s: marked image cannot be decoded: %v", tc.mediaType, err)
+			}
+		}
+	}
+
+	// VP8X header, with the canvas size taken from the VP8L header.
+	marked, _ := addMarker(webp, "image/webp")
+	if string(marked[12:16]) != "VP8X" || marked[20]&0x14 != 0x14 || marked[24] != 99 || marked[27] != 49 {
+		t.Fatalf("image/webp: invalid VP8X header % x", marked[12:30])
+	}
+
+	// Broken files must not be mistaken for marked ones, nor make findMarker panic.
+	var malformedTests = []struct {
+		name string
+		data []byte
+	}{
+		{"JPEG COM segment shorter than its length field", []byte{0xff, 0xd8, 0xff, 0xfe, 0, 0, 0, 0}},
+		{"JPEG COM segment of length 1", []byte{0xff, 0xd8, 0xff, 0xfe, 0, 1, 0, 0}},
+		{"JPEG segment past the end", []byte{0xff, 0xd8, 0xff, 0xfe, 0xff, 0xff, 'x'}},
+		{"AVIF box with a 64-bit size overflowing int", []byte("\x00\x00\x00\x10ftypavif\x00\x00\x00\x00\x00\x00\x00\x01uuid\x7f\xff\xff\xff\xff\xff\xff\xff")},
+		{"AVIF box with a 64-bit size above MaxInt64", []byte("\x00\x00\x00\x10ftypavif\x00\x00\x00\x00\x00\x00\x00\x01uuid\xff\xff\xff\xff\xff\xff\xff\xf0")},
+		{"AVIF box past the end", []byte("\x00\x00\x00\x10ftypavif\x00\x00\x00\x00\x00\x00\x01\x00uuid")},
+		{"AVIF box smaller than its header", []byte("\x00\x00\x00\x10ftypavif\x00\x00\x00\x00\x00\x00\x00\x04uuid")},
+	}
+	for _, tc := range malformedTests {
+		if text, found := findMarker(tc.data); found {
+			t.Fatalf("%s: found marker %q", tc.name, text)
+		}
+	}
+}
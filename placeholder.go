@@ -0,0 +1,281 @@
+// Low-quality image placeholders: a tiny version of each image as a data URI, its
+// BlurHash, and its dominant colour, to be shown while the real image loads.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Valid values for --placeholder: none, a tiny version scaled locally, or scaled by the API.
+var placeholderModes = []string{"none", "local", "api"}
+
+// Number of BlurHash components along the longest side of the image, and along the other one.
+const (
+	blurHashComponentsLong  = 4
+	blurHashComponentsShort = 3
+)
+
+// Characters used by the base 83 encoding of BlurHash.
+const base83Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// placeholder is what gets added to records and manifests.
+type placeholder struct {
+	DataURI        string `json:"data_uri"`        // Tiny version of the image.
+	Width          int    `json:"width"`           // Of the tiny version.
+	Height         int    `json:"height"`          // Of the tiny version.
+	BlurHash       string `json:"blurhash"`        // See https://blurha.sh/
+	DominantColour string `json:"dominant_colour"` // As "#rrggbb"; empty if fully transparent.
+	compressions   int64  // Used to make it.
+}
+
+// imagePlaceholder is the placeholder for the current image, so that it's only worked
+// out (and, with the API, paid for) once, even if it's used for several outputs.
+var imagePlaceholder *placeholder
+
+// placeholderCompressions is the number of additional compressions needed for
+// the placeholder of each image.
+func placeholderCompressions() int64 {
+	if setting.Placeholder == "api" {
+		return 1
+	}
+	return 0
+}
+
+// addPlaceholder adds the placeholder of the current image to its record, if requested
+// with --placeholder. The original is used if it's at hand, or else the result; failing
+// to make one is not a reason to fail, though.
+func addPlaceholder(source *Tinify.Source, result *Tinify.Result) *placeholder {
+	if setting.Placeholder == "none" || len(setting.Placeholder) == 0 {
+		return nil
+	}
+	if imagePlaceholder == nil {
+		p, err := makePlaceholder(source, result)
+		if err != nil {
+			setting.Logger.Warn().Msgf("addPlaceholder: cannot make a placeholder for %q: %s", setting.ImageName, err)
+			return nil
+		}
+		imagePlaceholder = p
+		if current != nil {
+			current.Compressions += p.compressions
+		}
+		setting.Logger.Debug().Msgf("addPlaceholder: %q: %dx%d, %d-byte data URI, BlurHash %q, dominant colour %s",
+			setting.ImageName, p.Width, p.Height, len(p.DataURI), p.BlurHash, p.DominantColour)
+	}
+	if current != nil {
+		current.Placeholder = imagePlaceholder
+	}
+	return imagePlaceholder
+}
+
+// makePlaceholder decodes the image, and scales it down so that its longest side is
+// --placeholder-size pixels; the BlurHash and the dominant colour are computed from that.
+// With --placeholder api, the data URI comes from the API instead, which charges for it.
+func makePlaceholder(source *Tinify.Source, result *Tinify.Result) (*placeholder, error) {
+	data := originalImage
+	if data == nil {
+		data = result.Data()
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil && result != nil {
+		// E.g. an AVIF original, converted to something we can read.
+		img, _, err = image.Decode(bytes.NewReader(result.Data()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	small := scaleDown(img, int(setting.PlaceholderSize))
+
+	p := &placeholder{
+		Width:    small.Bounds().Dx(),
+		Height:   small.Bounds().Dy(),
+		BlurHash: blurHash(small, parseColour(setting.PageColour)),
+	}
+	var colours colourSampler
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			colours.add(small.At(x, y))
+		}
+	}
+	p.DominantColour, _ = colours.pick()
+
+	if setting.Placeholder == "api" {
+		if p.DataURI, err = apiPlaceholder(source, img.Bounds()); err == nil {
+			p.compressions = 1
+			return p, nil
+		}
+		setting.Logger.Warn().Msgf("makePlaceholder: the API could not scale %q down, doing it locally instead: %s", setting.ImageName, err)
+	}
+
+	var buf bytes.Buffer
+	mediaType := "image/jpeg"
+	if small.Opaque() {
+		err = jpeg.Encode(&buf, small, &jpeg.Options{Quality: 70})
+	} else {
+		mediaType = "image/png"
+		err = png.Encode(&buf, small)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.DataURI = dataURI(mediaType, buf.Bytes())
+	return p, nil
+}
+
+// apiPlaceholder scales the uploaded image down through the API, returning it as a data URI.
+func apiPlaceholder(source *Tinify.Source, bounds image.Rectangle) (string, error) {
+	option := &Tinify.ResizeOption{Method: Tinify.ResizeMethodScale}
+	if bounds.Dx() >= bounds.Dy() {
+		option.Width = setting.PlaceholderSize
+	} else {
+		option.Height = setting.PlaceholderSize
+	}
+	v := source.Variant()
+	if err := v.Resize(option); err != nil {
+		return "", err
+	}
+	result, err := v.Result()
+	if err != nil {
+		return "", err
+	}
+	return dataURI(result.MediaType(), result.Data()), nil
+}
+
+// dataURI encodes data as a base64 data URI.
+func dataURI(mediaType string, data []byte) string {
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// scaleDown returns a copy of img whose longest side is size pixels (or less, for
+// images which are smaller than that already).
+func scaleDown(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if longest := max(w, h); longest > size {
+		w = max(1, int(math.Round(float64(w)*float64(size)/float64(longest))))
+		h = max(1, int(math.Round(float64(h)*float64(size)/float64(longest))))
+	}
+	small := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.BiLinear.Scale(small, small.Bounds(), img, bounds, xdraw.Src, nil)
+	return small
+}
+
+// blurHash encodes the image as a BlurHash (https://github.com/woltapp/blurhash), with
+// blurHashComponentsLong components along its longest side. BlurHash has no transparency,
+// so transparent pixels are blended with the background colour.
+func blurHash(img image.Image, background color.NRGBA) string {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	cx, cy := blurHashComponentsLong, blurHashComponentsShort
+	if h > w {
+		cx, cy = cy, cx
+	}
+
+	// Linear RGB of each pixel, blended with the background.
+	bg := [3]float64{float64(background.R) * 0x101, float64(background.G) * 0x101, float64(background.B) * 0x101}
+	pixels := make([][3]float64, 0, w*h)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			transparency := float64(0xffff-a) / 0xffff
+			pixels = append(pixels, [3]float64{
+				srgbToLinear((float64(r) + transparency*bg[0]) / 0xffff),
+				srgbToLinear((float64(g) + transparency*bg[1]) / 0xffff),
+				srgbToLinear((float64(b) + transparency*bg[2]) / 0xffff),
+			})
+		}
+	}
+
+	// Each component is the image multiplied by a cosine basis function.
+	factors := make([][3]float64, 0, cx*cy)
+	for j := range cy {
+		for i := range cx {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := range h {
+				for x := range w {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					for c := range f {
+						f[c] += basis * pixels[y*w+x][c]
+					}
+				}
+			}
+			for c := range f {
+				f[c] /= float64(w * h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(base83(cx-1+(cy-1)*9, 1))
+	maximum := 1.0
+	if len(factors) > 1 {
+		actual := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actual = max(actual, math.Abs(v))
+			}
+		}
+		quantised := int(max(0, min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		hash.WriteString(base83(quantised, 1))
+	} else {
+		hash.WriteString(base83(0, 1))
+	}
+	dc := factors[0]
+	hash.WriteString(base83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, f := range factors[1:] {
+		var value int
+		for _, v := range f {
+			q := int(max(0, min(18, math.Floor(signedPow(v/maximum, 0.5)*9+9.5))))
+			value = value*19 + q
+		}
+		hash.WriteString(base83(value, 2))
+	}
+	return hash.String()
+}
+
+// base83 encodes value with the given number of digits.
+func base83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83Digits[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+// srgbToLinear converts a channel, from 0 to 1, from sRGB to linear RGB.
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts a channel from linear RGB back to sRGB, from 0 to 255.
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signedPow raises the absolute value of v to exp, keeping its sign.
+func signedPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,89 @@
+// Tests for image placeholders.
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// Checks the BlurHash of solid images, whatever their orientation, with transparent
+// pixels blended with the background, and that some detail gets encoded too.
+func TestBlurHash(t *testing.T) {
+	solid := func(w, h int, c color.NRGBA) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := range h {
+			for x := range w {
+				img.SetNRGBA(x, y, c)
+			}
+		}
+		return img
+	}
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+
+	var blurHashTests = []struct {
+		name string
+		img  image.Image
+		want string
+	}{
+		// Black has no detail at all, so only the average colour is encoded.
+		{"black", solid(8, 6, color.NRGBA{0, 0, 0, 0xff}), "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"portrait", solid(6, 8, color.NRGBA{0, 0, 0, 0xff}), "T00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		// Transparent pixels are blended with the background.
+		{"transparent on white", solid(8, 6, color.NRGBA{}), blurHash(solid(8, 6, white), white)},
+	}
+	for _, tc := range blurHashTests {
+		if got := blurHash(tc.img, white); got != tc.want {
+			t.Fatalf("%s: got %q, expected %q", tc.name, got, tc.want)
+		}
+	}
+	if got := blurHash(solid(8, 6, white), white); got[2:6] != "TSUA" {
+		t.Fatalf("white: average colour encoded as %q, expected \"TSUA\" (0xffffff)", got[2:6])
+	}
+
+	// Some detail gets some AC components.
+	gradient := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := range 16 {
+		for x := range 16 {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(x * 16), 0x40, uint8(255 - y*16), 0xff})
+		}
+	}
+	if got := blurHash(gradient, white); len(got) != 28 || strings.HasSuffix(got, strings.Repeat("fQ", 11)) {
+		t.Fatalf("gradient: unexpected BlurHash %q", got)
+	}
+}
+
+// Checks the size, data URI and dominant colour of a placeholder made locally, from the
+// original image.
+func TestMakePlaceholder(t *testing.T) {
+	saved, savedImage := setting, originalImage
+	defer func() { setting, originalImage = saved, savedImage }()
+	setting.Placeholder, setting.PlaceholderSize, setting.PageColour = "local", 16, "white"
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	originalImage = buf.Bytes()
+
+	p, err := makePlaceholder(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Width != 16 || p.Height != 8 {
+		t.Fatalf("placeholder is %dx%d, expected 16x8", p.Width, p.Height)
+	}
+	if !strings.HasPrefix(p.DataURI, "data:image/jpeg;base64,") {
+		t.Fatalf("unexpected data URI for an opaque image: %.40q", p.DataURI)
+	}
+	if p.DominantColour != "#ffffff" {
+		t.Fatalf("dominant colour is %q, expected #ffffff", p.DominantColour)
+	}
+}
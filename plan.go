@@ -0,0 +1,191 @@
+// Dry-run mode: figures out what would be done, and how many compressions it
+// would cost, without uploading anything to the API.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Number of compressions per month that are free of charge.
+const freeMonthlyCompressions = 500
+
+// errDryRun is returned by openStream in dry-run mode, after all local checks have passed,
+// to let the caller know that nothing else should be done.
+var errDryRun = errors.New("dry run: nothing uploaded")
+
+// planItem describes one image that would have been processed.
+type planItem struct {
+	Operation    string `json:"operation"`
+	Input        string `json:"input"`
+	Output       string `json:"output"`
+	MediaType    string `json:"media_type,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Compressions int64  `json:"compressions"`
+}
+
+// plan is the whole set of planned work, plus the estimated cost.
+type plan struct {
+	Items                []planItem `json:"items"`
+	Images               int        `json:"images"`
+	Compressions         int64      `json:"compressions"`
+	LastCount            int64      `json:"last_compression_count"`
+	LastCountTime        time.Time  `json:"last_compression_count_time,omitzero"`
+	ProjectedCount       int64      `json:"projected_compression_count"`
+	FreeMonthlyAllowance int64      `json:"free_monthly_allowance"`
+}
+
+// All planned work so far.
+var plannedItems []planItem
+
+// compressionsFor estimates how many compressions an operation will use.
+// Uploading an image counts as one; resizing and converting count as one more each.
+// Chained operations (see `process`) are joined with a "+", e.g. "resize+convert".
+func compressionsFor(operation string) int64 {
+	count := int64(1)
+	for op := range strings.SplitSeq(operation, "+") {
+		switch op {
+		case "resize", "convert":
+			count++
+		}
+	}
+	return count
+}
+
+// addPlanItem records that an image would be processed by the current operation.
+func addPlanItem(input, output, mediaType string, size int64) {
+	if len(input) == 0 {
+		input = "-"
+	}
+	if len(output) == 0 {
+		output = "-"
+		if len(setting.OutputTemplate) > 0 {
+			output = expandOutputTemplate(setting.OutputTemplate, input, nil)
+		}
+	}
+	plannedItems = append(plannedItems, planItem{
+		Operation:    setting.Operation,
+		Input:        input,
+		Output:       output,
+		MediaType:    mediaType,
+		Size:         size,
+		Compressions: compressionsFor(setting.Operation) + placeholderCompressions(),
+	})
+}
+
+// setPlanCompressions overrides the estimate for the last planned item, for
+// operations where it depends on more than the operation name (e.g. `srcset`).
+func setPlanCompressions(count int64) {
+	if len(plannedItems) > 0 {
+		plannedItems[len(plannedItems)-1].Compressions = count + placeholderCompressions()
+	}
+}
+
+// printPlan writes the plan to w, either as text or as JSON.
+func printPlan(w io.Writer, format string) error {
+	p := plan{
+		Items:                plannedItems,
+		Images:               len(plannedItems),
+		FreeMonthlyAllowance: freeMonthlyCompressions,
+	}
+	for _, item := range plannedItems {
+		p.Compressions += item.Compressions
+	}
+	p.LastCount, p.LastCountTime = lastCompressionCount()
+	p.ProjectedCount = p.LastCount + p.Compressions
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "\t")
+		return encoder.Encode(p)
+	}
+
+	fmt.Fprintln(w, "PLAN (dry run, nothing was uploaded):")
+	for _, item := range p.Items {
+		fmt.Fprintf(w, "  %-9s %s -> %s", item.Operation, item.Input, item.Output)
+		if len(item.MediaType) > 0 {
+			fmt.Fprintf(w, " (%s, %d byte(s))", item.MediaType, item.Size)
+		}
+		fmt.Fprintf(w, ": %d compression(s)\n", item.Compressions)
+	}
+	fmt.Fprintf(w, "Total: %d image(s), %d compression(s)\n", p.Images, p.Compressions)
+	if p.LastCountTime.IsZero() {
+		fmt.Fprintln(w, "No compression count known for this month yet.")
+	} else {
+		fmt.Fprintf(w, "Last known compression count: %d (as of %s)\n", p.LastCount, p.LastCountTime.Format(time.DateTime))
+	}
+	fmt.Fprintf(w, "Compression count after this run: %d of %d free this month", p.ProjectedCount, p.FreeMonthlyAllowance)
+	if p.ProjectedCount > p.FreeMonthlyAllowance {
+		fmt.Fprintf(w, " (%d over the free allowance)\n", p.ProjectedCount-p.FreeMonthlyAllowance)
+	} else {
+		fmt.Fprintf(w, " (%d remaining)\n", p.FreeMonthlyAllowance-p.ProjectedCount)
+	}
+	return nil
+}
+
+// countState is what gets saved about the compression count between runs.
+type countState struct {
+	CompressionCount int64     `json:"compression_count"`
+	Updated          time.Time `json:"updated"`
+}
+
+// countStatePath returns the path to the file where the last compression count is kept.
+// Each key has its own count, so the file is named after a hash of the key, which is
+// not worth keeping around in the clear.
+func countStatePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tinify-go", "compression-count-"+hashBytes([]byte(setting.Key))[:16]+".json"), nil
+}
+
+// saveCompressionCount remembers the compression count returned by the last API call;
+// it's added to the usage history at the end of the run (see recordUsage).
+func saveCompressionCount(count int64) error {
+	runCompressionCount = count
+	path, err := countStatePath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(countState{
+		CompressionCount: count,
+		Updated:          time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// lastCompressionCount returns the last known compression count, and when it was
+// retrieved. Since the count is reset every month, older counts are ignored.
+func lastCompressionCount() (int64, time.Time) {
+	path, err := countStatePath()
+	if err != nil {
+		return 0, time.Time{}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, time.Time{}
+	}
+	var state countState
+	if err = json.Unmarshal(data, &state); err != nil {
+		setting.Logger.Debug().Msgf("lastCompressionCount: ignoring corrupted %q: %s", path, err)
+		return 0, time.Time{}
+	}
+	now := time.Now()
+	if state.Updated.Year() != now.Year() || state.Updated.Month() != now.Month() {
+		return 0, time.Time{}
+	}
+	return state.CompressionCount, state.Updated
+}
@@ -0,0 +1,168 @@
+// Tests for dry-run plans.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+)
+
+// Checks the compressions estimated for each operation and chain, as planned by each
+// action in dry-run mode, and the totals of the printed plan.
+func TestPlan(t *testing.T) {
+	saved := setting
+	defer func() { setting, plannedItems, current, records, summaryRecords = saved, nil, nil, nil, nil }()
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+
+	var compressionTests = []struct {
+		operation string
+		want      int64
+	}{
+		{"compress", 1},
+		{"resize", 2},
+		{"convert", 2},
+		{"transform", 1},
+		{"resize+convert", 3},
+		{"resize+transform", 2},
+		{"resize+convert+transform", 3},
+	}
+	for _, tc := range compressionTests {
+		if got := compressionsFor(tc.operation); got != tc.want {
+			t.Fatalf("%s: estimated %d compression(s), expected %d", tc.operation, got, tc.want)
+		}
+	}
+
+	// Each action, on a real image, in dry-run mode.
+	dir := t.TempDir()
+	stringFlags := func(names ...string) []cli.Flag {
+		flags := make([]cli.Flag, len(names))
+		for i, name := range names {
+			flags[i] = &cli.StringFlag{Name: name}
+		}
+		return flags
+	}
+	var planTests = []struct {
+		name        string
+		action      cli.ActionFunc
+		flags       []cli.Flag
+		args        []string
+		setup       func()
+		placeholder string
+		want        int64
+	}{
+		{"compress", compress, nil, nil, nil, "none", 1},
+		{"compress", compress, nil, nil, nil, "api", 2},
+		{"resize", resize, nil, nil, func() { setting.Width = 100 }, "none", 2},
+		{"resize", resize, nil, nil, func() { setting.Presets = "og,thumb-150" }, "none", 3},
+		{"convert", convert, []cli.Flag{&cli.StringFlag{Name: "type", Destination: &setting.FileType}}, []string{"--type", "webp,avif"}, nil, "none", 2},
+		{"convert", convert, []cli.Flag{&cli.StringFlag{Name: "type", Destination: &setting.FileType}}, []string{"--type", "webp,avif"}, func() { setting.EachType = true }, "none", 3},
+		{"transform", transform, nil, nil, func() { setting.Transform = "white" }, "none", 1},
+		{"process", process, stringFlags("resize", "convert", "background"), []string{"--resize", "fit:100x100", "--convert", "webp"}, nil, "none", 3},
+		{"process", process, stringFlags("resize", "convert", "background"), []string{"--convert", "webp", "--background", "white"}, func() { setting.Transform = "white" }, "none", 2},
+		{"srcset", srcset, stringFlags("widths", "formats", "manifest"), []string{"--widths", "100,200", "--formats", "webp,avif"}, nil, "none", 9},
+		{"srcset", srcset, stringFlags("widths", "formats", "manifest"), []string{"--widths", "100", "--formats", "webp"}, nil, "api", 4},
+		// Widths larger than the original (2880px), and repeated ones, are not made.
+		{"srcset", srcset, stringFlags("widths", "formats", "manifest"), []string{"--widths", "100,100,4000", "--formats", "webp"}, nil, "none", 3},
+		{"srcset", srcset, stringFlags("widths", "formats", "manifest"), []string{"--widths", "4000,5000", "--formats", "webp,avif"}, nil, "none", 5},
+		{"icons", icons, stringFlags("sizes", "method", "out", "name"), []string{"--sizes", "16,32"}, nil, "none", 5},
+	}
+	var total int64
+	for i, tc := range planTests {
+		setting = saved
+		setting.DryRun, setting.Placeholder, setting.OutputFormat = true, tc.placeholder, ""
+		setting.ImageName, setting.OutputFileName, setting.OutputTemplate = "testdata/input/test.jpg", filepath.Join(dir, "out.jpg"), ""
+		setting.Method, setting.Width, setting.Height, setting.Presets, setting.EachType, setting.Transform = Tinify.ResizeMethodScale, 0, 0, "", false, ""
+		if tc.name == "srcset" || tc.name == "icons" {
+			setting.OutputFileName = dir
+		}
+		if tc.setup != nil {
+			tc.setup()
+		}
+		cmd := &cli.Command{Name: tc.name, Flags: tc.flags, Action: tc.action}
+		if err := cmd.Run(context.Background(), append([]string{tc.name}, tc.args...)); err != nil {
+			t.Fatalf("%s %q: %s", tc.name, tc.args, err)
+		}
+		if len(plannedItems) != i+1 {
+			t.Fatalf("%s %q: %d item(s) planned, expected %d", tc.name, tc.args, len(plannedItems), i+1)
+		}
+		if got := plannedItems[i].Compressions; got != tc.want {
+			t.Fatalf("%s %q, placeholder %s: planned %d compression(s), expected %d", tc.name, tc.args, tc.placeholder, got, tc.want)
+		}
+		total += tc.want
+	}
+
+	// Planned items with no output go to STDOUT, unless there's a template.
+	setting.Operation, setting.Placeholder, setting.OutputTemplate = "compress", "none", "{dir}/{name}.min.{ext}"
+	addPlanItem("", "", "image/png", 1000)
+	if item := plannedItems[len(plannedItems)-1]; item.Input != "-" || item.Output != "./stdin.min.{ext}" {
+		t.Fatalf("planned %q -> %q, expected - -> ./stdin.min.{ext}", item.Input, item.Output)
+	}
+	setPlanCompressions(7)
+	total += 7
+
+	if err := saveCompressionCount(42); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := printPlan(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var p plan
+	if err := json.Unmarshal(buf.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Images != len(planTests)+1 || p.Compressions != total || p.LastCount != 42 || p.ProjectedCount != 42+total {
+		t.Fatalf("got plan for %d image(s), %d compression(s), count %d -> %d; expected %d, %d, 42 -> %d",
+			p.Images, p.Compressions, p.LastCount, p.ProjectedCount, len(planTests)+1, total, 42+total)
+	}
+	buf.Reset()
+	if err := printPlan(&buf, "text"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("Total: %d image(s), %d compression(s)\n", len(planTests)+1, total),
+		"Last known compression count: 42",
+		fmt.Sprintf("Compression count after this run: %d of 500 free this month (%d remaining)\n", 42+total, 500-42-total),
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("printed plan %q does not include %q", buf.String(), want)
+		}
+	}
+}
+
+// Checks that the last compression count is remembered separately for each key.
+func TestCompressionCountPerKey(t *testing.T) {
+	saved := setting
+	defer func() { setting, runCompressionCount = saved, 0 }()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+
+	for key, count := range map[string]int64{"first-key": 10, "second-key": 20} {
+		setting.Key = key
+		if got, _ := lastCompressionCount(); got != 0 {
+			t.Fatalf("%s: got compression count %d before saving any", key, got)
+		}
+		if err := saveCompressionCount(count); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, want := range map[string]int64{"first-key": 10, "second-key": 20, "third-key": 0} {
+		setting.Key = key
+		if got, _ := lastCompressionCount(); got != want {
+			t.Fatalf("%s: got compression count %d, expected %d", key, got, want)
+		}
+		if path, _ := countStatePath(); strings.Contains(path, key) {
+			t.Fatalf("%s: the key is in the clear on %q", key, path)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Named size presets for resizing, e.g. `resize --preset og`: a few built-in ones,
+// plus whatever is defined on the configuration files.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+)
+
+// resizePreset is a named combination of resizing method, width and height.
+type resizePreset struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	Width  int64  `json:"width,omitempty"`
+	Height int64  `json:"height,omitempty"`
+	Source string `json:"source"` // "built-in", or the configuration file where it was defined.
+}
+
+// Presets which are always available, unless redefined on a configuration file.
+var builtinPresets = []resizePreset{
+	{Name: "og", Method: Tinify.ResizeMethodCover, Width: 1200, Height: 630},                // Open Graph (Facebook, LinkedIn...)
+	{Name: "twitter-card", Method: Tinify.ResizeMethodCover, Width: 1200, Height: 675},      // Summary card with large image.
+	{Name: "instagram-square", Method: Tinify.ResizeMethodCover, Width: 1080, Height: 1080}, // Square post.
+	{Name: "thumb-150", Method: Tinify.ResizeMethodThumb, Width: 150, Height: 150},
+	{Name: "hd", Method: Tinify.ResizeMethodFit, Width: 1920, Height: 1080},
+}
+
+// checkPreset makes sure that a preset can be passed to the API as it is.
+func checkPreset(p resizePreset) error {
+	if err := checkResize(p.Method, p.Width, p.Height); err != nil {
+		return fmt.Errorf("preset %q: %w", p.Name, err)
+	}
+	return nil
+}
+
+// presetFromConfig converts a preset defined on a configuration file, either as a
+// resize specification (e.g. banner = "cover:1500x500"), or as a table with method,
+// width and height.
+func presetFromConfig(name string, value any, path string) (resizePreset, error) {
+	p := resizePreset{Name: name, Source: path}
+	switch v := value.(type) {
+	case string:
+		var err error
+		if p.Method, p.Width, p.Height, err = parseResizeSpec(v); err != nil {
+			return p, fmt.Errorf("preset %q on %q: %w", name, path, err)
+		}
+	case map[string]any:
+		p.Method = Tinify.ResizeMethodScale
+		for key, value := range normaliseConfigKeys(v) {
+			var err error
+			switch s := fmt.Sprint(value); key {
+			case "method":
+				p.Method = strings.ToLower(s)
+			case "width":
+				p.Width, err = strconv.ParseInt(s, 10, 64)
+			case "height":
+				p.Height, err = strconv.ParseInt(s, 10, 64)
+			default:
+				err = fmt.Errorf("unknown key %q", key)
+			}
+			if err != nil {
+				return p, fmt.Errorf("preset %q on %q: %w", name, path, err)
+			}
+		}
+	default:
+		return p, fmt.Errorf("preset %q on %q: expected a resize specification or a table", name, path)
+	}
+	return p, checkPreset(p)
+}
+
+// allPresets returns all available presets, indexed by name: the built-in ones,
+// overridden by those on the user file, overridden by those on the project file.
+func allPresets() (map[string]resizePreset, error) {
+	loadConfig()
+	if config.err != nil {
+		return nil, config.err
+	}
+	presets := make(map[string]resizePreset, len(builtinPresets))
+	for _, p := range builtinPresets {
+		p.Source = "built-in"
+		presets[p.Name] = p
+	}
+	for _, cf := range []*configFile{config.user, config.project} {
+		if cf == nil {
+			continue
+		}
+		for name, value := range cf.presets {
+			p, err := presetFromConfig(name, value, cf.path)
+			if err != nil {
+				return nil, fmt.Errorf("config: %w", err)
+			}
+			presets[name] = p
+		}
+	}
+	return presets, nil
+}
+
+// lookupPresets returns the presets with the given comma-separated names, in order.
+func lookupPresets(names string) ([]resizePreset, error) {
+	presets, err := allPresets()
+	if err != nil {
+		return nil, err
+	}
+	var found []resizePreset
+	for name := range strings.SplitSeq(strings.ToLower(names), ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 || slices.ContainsFunc(found, func(p resizePreset) bool { return p.Name == name }) {
+			continue
+		}
+		p, ok := presets[name]
+		if !ok {
+			return nil, fmt.Errorf("resize: unknown preset %q; available presets are: %s", name, strings.Join(slices.Sorted(maps.Keys(presets)), ", "))
+		}
+		found = append(found, p)
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("resize: no preset given")
+	}
+	return found, nil
+}
+
+// usePreset sets the resizing method, width and height from the preset.
+func usePreset(p resizePreset) {
+	setting.Preset = p.Name
+	setting.Method, setting.Width, setting.Height = p.Method, p.Width, p.Height
+}
+
+// resizeEach resizes the uploaded image with each of the presets, and writes each
+// result on its own, as soon as it arrives.
+func resizeEach(source *Tinify.Source, presets []resizePreset) error {
+	return eachOutput(len(presets), func(i int) (int64, error) {
+		usePreset(presets[i])
+		if activeLedger != nil && activeLedger.pending != nil {
+			// Each preset is a different operation, as far as the ledger is concerned.
+			activeLedger.pending.Operations = operationSignature()
+		}
+		v := source.Variant()
+		if err := applyOperation(v, "resize", &setting, originalImage); err != nil {
+			return 0, err
+		}
+		result, err := v.Result()
+		if err != nil {
+			return 0, fmt.Errorf("resize: preset %q failed: %w", presets[i].Name, err)
+		}
+		return 1, writeResult(source, result)
+	})
+}
+
+// presetsList is the action for `presets list`.
+func presetsList(ctx context.Context, cmd *cli.Command) error {
+	presets, err := allPresets()
+	if err != nil {
+		return err
+	}
+	sorted := slices.SortedFunc(maps.Values(presets), func(a, b resizePreset) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	if setting.OutputFormat == "json" || setting.OutputFormat == "ndjson" {
+		encoder := json.NewEncoder(os.Stdout)
+		if setting.OutputFormat == "json" {
+			encoder.SetIndent("", "\t")
+		}
+		return encoder.Encode(sorted)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMETHOD\tWIDTH\tHEIGHT\tSOURCE")
+	for _, p := range sorted {
+		width, height := "-", "-"
+		if p.Width > 0 {
+			width = strconv.FormatInt(p.Width, 10)
+		}
+		if p.Height > 0 {
+			height = strconv.FormatInt(p.Height, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Name, p.Method, width, height, p.Source)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,47 @@
+// Tests for resize presets.
+package main
+
+import "testing"
+
+// Checks the built-in presets, and those defined on configuration files, either as
+// resize specifications or as tables.
+func TestPresets(t *testing.T) {
+	for _, p := range builtinPresets {
+		if err := checkPreset(p); err != nil {
+			t.Fatalf("built-in preset: %s", err)
+		}
+	}
+
+	var presetTests = []struct {
+		name  string
+		value any
+		want  resizePreset // Without the name and source.
+		fails bool
+	}{
+		{"spec", "cover:1500x500", resizePreset{Method: "cover", Width: 1500, Height: 500}, false},
+		{"scale", "scale:x600", resizePreset{Method: "scale", Height: 600}, false},
+		{"table", map[string]any{"method": "thumb", "width": int64(256), "height": int64(256)}, resizePreset{Method: "thumb", Width: 256, Height: 256}, false},
+		{"table with scale by default", map[string]any{"width": int64(800)}, resizePreset{Method: "scale", Width: 800}, false},
+		{"fit without height", "fit:800", resizePreset{}, true},
+		{"scale with both", map[string]any{"width": 800, "height": 600}, resizePreset{}, true},
+		{"unknown method", "stretch:800x600", resizePreset{}, true},
+		{"unknown key", map[string]any{"width": 800, "colour": "red"}, resizePreset{}, true},
+		{"not a preset", 42, resizePreset{}, true},
+	}
+	for _, tc := range presetTests {
+		got, err := presetFromConfig(tc.name, tc.value, "tinify.toml")
+		if tc.fails {
+			if err == nil {
+				t.Fatalf("%s: got %+v, and no error", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		got.Name, got.Source = "", ""
+		if got != tc.want {
+			t.Fatalf("%s: got %+v, expected %+v", tc.name, got, tc.want)
+		}
+	}
+}
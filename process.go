@@ -0,0 +1,96 @@
+// Chained operations: resize, convert and transform an image, all with a single
+// upload and a single download.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+)
+
+// process applies all the requested operations in a single API call.
+func process(ctx context.Context, cmd *cli.Command) error {
+	var (
+		err    error // declared here due to scope issues.
+		source *Tinify.Source
+		ops    []string // operations to apply, in order.
+	)
+
+	if cmd.IsSet("resize") {
+		if setting.Method, setting.Width, setting.Height, err = parseResizeSpec(cmd.String("resize")); err != nil {
+			return err
+		}
+		ops = append(ops, "resize")
+	}
+	if cmd.IsSet("convert") {
+		setting.FileType = strings.ToLower(cmd.String("convert"))
+		ops = append(ops, "convert")
+	}
+	if cmd.IsSet("background") {
+		ops = append(ops, "transform")
+	}
+	if len(ops) == 0 {
+		return fmt.Errorf("process: nothing to do; use at least one of --resize, --convert or --background")
+	}
+	for _, op := range ops {
+		if err = checkOperation(op, &setting); err != nil {
+			return err
+		}
+	}
+
+	setting.Operation = strings.Join(ops, "+")
+	setting.Logger.Debug().Msgf("process called, operations: %q", setting.Operation)
+
+	if ctx, source, err = openStream(ctx); errors.Is(err, errDryRun) || isSkipped(err) {
+		return nil
+	} else if err != nil {
+		setting.Logger.Error().Msgf("process: invalid filenames, error was %v", err)
+		return err
+	}
+
+	for _, op := range ops {
+		if err = applyOperation(source, op, &setting, originalImage); err != nil {
+			return err
+		}
+	}
+	return callAPI(ctx, cmd, source)
+}
+
+// parseResizeSpec parses a resize specification such as "fit:800x600", "scale:800"
+// (width only) or "scale:x600" (height only). The method may be omitted, in
+// which case "scale" is assumed.
+func parseResizeSpec(spec string) (method string, width, height int64, err error) {
+	original := spec
+	method = Tinify.ResizeMethodScale
+	if m, dimensions, found := strings.Cut(spec, ":"); found {
+		method, spec = strings.ToLower(m), dimensions
+	}
+	if !slices.Contains(methods, method) {
+		return "", 0, 0, fmt.Errorf("invalid resize method: %q", method)
+	}
+
+	w, h, _ := strings.Cut(strings.ToLower(spec), "x")
+	if len(w) > 0 {
+		if width, err = strconv.ParseInt(w, 10, 64); err != nil || width < 1 {
+			return "", 0, 0, fmt.Errorf("invalid width in resize specification %q", spec)
+		}
+	}
+	if len(h) > 0 {
+		if height, err = strconv.ParseInt(h, 10, 64); err != nil || height < 1 {
+			return "", 0, 0, fmt.Errorf("invalid height in resize specification %q", spec)
+		}
+	}
+	if width == 0 && height == 0 {
+		return "", 0, 0, fmt.Errorf("resize specification %q has neither width nor height", spec)
+	}
+	if err = checkResize(method, width, height); err != nil {
+		return "", 0, 0, fmt.Errorf("invalid resize specification %q: %w", original, err)
+	}
+	return method, width, height, nil
+}
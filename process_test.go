@@ -0,0 +1,38 @@
+// Tests for `process`.
+package main
+
+import "testing"
+
+// Checks the parsing of resize specifications used by `process`.
+func TestParseResizeSpec(t *testing.T) {
+	var specTests = []struct {
+		spec   string
+		method string
+		width  int64
+		height int64
+		valid  bool
+	}{
+		{"fit:800x600", "fit", 800, 600, true},
+		{"cover:100X50", "cover", 100, 50, true},
+		{"scale:800", "scale", 800, 0, true},
+		{"scale:x600", "scale", 0, 600, true},
+		{"800", "scale", 800, 0, true},
+		{"stretch:800x600", "", 0, 0, false},
+		{"fit:", "", 0, 0, false},
+		{"fit:0x600", "", 0, 0, false},
+		{"fit:ax600", "", 0, 0, false},
+		{"fit:800", "", 0, 0, false},
+		{"cover:x600", "", 0, 0, false},
+		{"scale:800x600", "", 0, 0, false},
+	}
+
+	for _, tc := range specTests {
+		method, width, height, err := parseResizeSpec(tc.spec)
+		if (err == nil) != tc.valid {
+			t.Fatalf("parsed %q and got error %v, expected valid to be %t", tc.spec, err, tc.valid)
+		}
+		if method != tc.method || width != tc.width || height != tc.height {
+			t.Fatalf("parsed %q and got (%q, %d, %d), expected (%q, %d, %d)", tc.spec, method, width, height, tc.method, tc.width, tc.height)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Perceptual quality metrics: SSIM and PSNR between the original and the result,
+// to guard against visible degradation.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg" // registers the decoders used by image.Decode.
+	_ "image/png"
+	"math"
+	"os"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Valid values for --low-quality.
+var lowQualityActions = []string{"reject", "warn"}
+
+// PSNR reported for identical images, which would otherwise be infinite.
+const maxPSNR = 100
+
+// qualityScores is how close the result is to the original.
+type qualityScores struct {
+	SSIM float64 `json:"ssim"` // Structural similarity, from 0 to 1 (identical).
+	PSNR float64 `json:"psnr"` // Peak signal-to-noise ratio, in dB; maxPSNR if identical.
+}
+
+// errCropped is returned by compareImages when the images have different aspect ratios,
+// e.g. after resizing with cover or thumb: since only the API knows which part of the
+// image it kept, there is nothing to compare the result with.
+var errCropped = errors.New("the aspect ratio changed, e.g. after cropping")
+
+// compareImages decodes both images, scales the first one to the size of the second
+// if needed, and computes their SSIM and PSNR. AVIF cannot be decoded, so far.
+func compareImages(original, result []byte) (qualityScores, error) {
+	a, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return qualityScores{}, fmt.Errorf("cannot decode the original: %w", err)
+	}
+	b, _, err := image.Decode(bytes.NewReader(result))
+	if err != nil {
+		return qualityScores{}, fmt.Errorf("cannot decode the result: %w", err)
+	}
+	bounds := image.Rect(0, 0, b.Bounds().Dx(), b.Bounds().Dy())
+	if bounds.Empty() {
+		return qualityScores{}, fmt.Errorf("empty image")
+	}
+	// Scaling may be off by a pixel, after rounding.
+	aw, ah, bw, bh := float64(a.Bounds().Dx()), float64(a.Bounds().Dy()), float64(bounds.Dx()), float64(bounds.Dy())
+	if aw == 0 || ah == 0 || math.Abs(ah*bw/aw-bh) > 1 || math.Abs(aw*bh/ah-bw) > 1 {
+		return qualityScores{}, errCropped
+	}
+	ra := image.NewRGBA(bounds)
+	if a.Bounds().Size() == bounds.Size() {
+		draw.Draw(ra, bounds, a, a.Bounds().Min, draw.Src)
+	} else {
+		xdraw.BiLinear.Scale(ra, bounds, a, a.Bounds(), xdraw.Src, nil)
+	}
+	rb := image.NewRGBA(bounds)
+	draw.Draw(rb, bounds, b, b.Bounds().Min, draw.Src)
+
+	return qualityScores{SSIM: ssim(ra, rb), PSNR: psnr(ra, rb)}, nil
+}
+
+// psnr computes the peak signal-to-noise ratio over the RGB channels of two images
+// of the same size.
+func psnr(a, b *image.RGBA) float64 {
+	var sum float64
+	n := 0
+	for i := 0; i < len(a.Pix); i += 4 {
+		for c := range 3 {
+			d := float64(a.Pix[i+c]) - float64(b.Pix[i+c])
+			sum += d * d
+			n++
+		}
+	}
+	if sum == 0 {
+		return maxPSNR
+	}
+	mse := sum / float64(n)
+	return min(maxPSNR, 10*math.Log10(255*255/mse))
+}
+
+// luma returns the luminance of each pixel (BT.601), as a flat slice.
+func luma(img *image.RGBA) []float64 {
+	l := make([]float64, 0, len(img.Pix)/4)
+	for i := 0; i < len(img.Pix); i += 4 {
+		l = append(l, 0.299*float64(img.Pix[i])+0.587*float64(img.Pix[i+1])+0.114*float64(img.Pix[i+2]))
+	}
+	return l
+}
+
+// ssim computes the mean structural similarity of the luminance of two images of
+// the same size, over 8×8 windows, overlapping by half.
+func ssim(a, b *image.RGBA) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	width, height := a.Rect.Dx(), a.Rect.Dy()
+	la, lb := luma(a), luma(b)
+	window := min(8, width, height)
+	step := max(1, window/2)
+
+	var total float64
+	windows := 0
+	for y := 0; y+window <= height; y += step {
+		for x := 0; x+window <= width; x += step {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for wy := y; wy < y+window; wy++ {
+				for wx := x; wx < x+window; wx++ {
+					pa, pb := la[wy*width+wx], lb[wy*width+wx]
+					sumA += pa
+					sumB += pb
+					sumAA += pa * pa
+					sumBB += pb * pb
+					sumAB += pa * pb
+				}
+			}
+			n := float64(window * window)
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) / ((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	return total / float64(windows)
+}
+
+// checkQuality computes the scores of the result, if --min-ssim was given, adding them
+// to the current record. Below the minimum, the result is either rejected (keeping the
+// original, as for insufficient gain), or just flagged, depending on --low-quality.
+func checkQuality(source *Tinify.Source, result *Tinify.Result, output string) error {
+	if setting.MinSSIM <= 0 || originalImage == nil {
+		return nil
+	}
+	scores, err := compareImages(originalImage, result.Data())
+	if errors.Is(err, errCropped) {
+		setting.Logger.Info().Msgf("checkQuality: %q was cropped, so its quality cannot be checked", setting.ImageName)
+		return nil
+	} else if err != nil {
+		// E.g. AVIF; not a reason to fail.
+		setting.Logger.Warn().Msgf("checkQuality: cannot compare %q with its result: %s", setting.ImageName, err)
+		return nil
+	}
+	if current != nil {
+		current.SSIM, current.PSNR = scores.SSIM, scores.PSNR
+	}
+	if scores.SSIM >= setting.MinSSIM {
+		return nil
+	}
+	reason := fmt.Sprintf("quality too low: SSIM %.4f < %.4f", scores.SSIM, setting.MinSSIM)
+	if setting.LowQuality == "warn" {
+		setting.Logger.Warn().Msgf("checkQuality: %q: %s", setting.ImageName, reason)
+		if current != nil {
+			current.LowQuality = true
+		}
+		return nil
+	}
+	setting.Logger.Info().Msgf("checkQuality: %q: %s; keeping the original", setting.ImageName, reason)
+	return keepOriginal(source, result, output, reason)
+}
+
+// compareFiles is the action for the `compare` command.
+func compareFiles(ctx context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 2 {
+		return fmt.Errorf("compare: expected two images, got %d", cmd.Args().Len())
+	}
+	a, err := os.ReadFile(cmd.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(cmd.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	scores, err := compareImages(a, b)
+	if err != nil {
+		return fmt.Errorf("compare: %w", err)
+	}
+
+	if setting.OutputFormat == "json" || setting.OutputFormat == "ndjson" {
+		encoder := json.NewEncoder(os.Stdout)
+		if setting.OutputFormat == "json" {
+			encoder.SetIndent("", "\t")
+		}
+		if err = encoder.Encode(scores); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("SSIM: %.4f\nPSNR: %.2f dB\n", scores.SSIM, scores.PSNR)
+	}
+	// So that scripts can tell.
+	if setting.MinSSIM > 0 && scores.SSIM < setting.MinSSIM {
+		return cli.Exit(fmt.Sprintf("compare: SSIM %.4f is below the minimum of %.4f", scores.SSIM, setting.MinSSIM), 1)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Tests for the quality checks of results.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// Checks that the SSIM of similar images falls within the expected range, even when
+// their sizes differ, and that cropped images are not compared at all.
+func TestCompareImages(t *testing.T) {
+	// A gradient, the same with a little noise, at other sizes, and cropped: just the
+	// part from x0 to x1 (as fractions of the width) is kept.
+	crop := func(width, height int, noise int, x0, x1 float64) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := range height {
+			for x := range width {
+				u := x0 + (x1-x0)*float64(x)/float64(width)
+				v := (int(u*255) + y*255/height) / 2
+				if noise > 0 && (x*7+y*13)%5 == 0 {
+					v = min(255, v+noise)
+				}
+				img.Pix[img.PixOffset(x, y)] = uint8(v)
+				img.Pix[img.PixOffset(x, y)+1] = uint8(v)
+				img.Pix[img.PixOffset(x, y)+2] = uint8(255 - v)
+				img.Pix[img.PixOffset(x, y)+3] = 0xff
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("cannot encode test image: %s", err)
+		}
+		return buf.Bytes()
+	}
+	encode := func(width, height int, noise int) []byte {
+		return crop(width, height, noise, 0, 1)
+	}
+	original := encode(64, 48, 0)
+
+	var compareTests = []struct {
+		name     string
+		result   []byte
+		min, max float64 // Expected SSIM range; zero if it's expected to be cropped.
+	}{
+		{"identical", original, 1, 1},
+		{"noisy", encode(64, 48, 10), 0.5, 0.99},
+		{"scaled", encode(32, 24, 0), 0.95, 1},
+		{"scaled and rounded", encode(43, 32, 0), 0.95, 1},
+		{"cover", crop(32, 32, 0, 0.125, 0.875), 0, 0},
+		{"thumb", crop(48, 16, 0, 0, 1), 0, 0},
+	}
+	for _, tc := range compareTests {
+		scores, err := compareImages(original, tc.result)
+		if tc.max == 0 {
+			if !errors.Is(err, errCropped) {
+				t.Fatalf("%s: expected the images not to be compared, got %+v (error: %v)", tc.name, scores, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if scores.SSIM < tc.min || scores.SSIM > tc.max {
+			t.Fatalf("%s: got SSIM %.4f, expected between %.2f and %.2f", tc.name, scores.SSIM, tc.min, tc.max)
+		}
+		if tc.name == "identical" && scores.PSNR != maxPSNR {
+			t.Fatalf("%s: got PSNR %.2f, expected %d", tc.name, scores.PSNR, maxPSNR)
+		}
+	}
+
+	if _, err := compareImages(original, []byte("not an image")); err == nil {
+		t.Fatalf("compared with garbage, and got no error")
+	}
+}
@@ -0,0 +1,227 @@
+// Machine-readable reports: one record per processed image, so that scripts
+// don't need to scrape the log messages.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+)
+
+// Valid values for --output-format; empty means no report at all.
+var outputFormats = []string{"text", "json", "ndjson"}
+
+// record describes what happened to one image.
+type record struct {
+	Operation        string       `json:"operation"`
+	Input            string       `json:"input"`
+	Output           string       `json:"output"`
+	BytesBefore      int64        `json:"bytes_before"`
+	BytesAfter       int64        `json:"bytes_after"`
+	Savings          float64      `json:"savings_percent"`
+	Width            int64        `json:"width"`
+	Height           int64        `json:"height"`
+	MediaType        string       `json:"media_type"`
+	CompressionCount int64        `json:"compression_count"`
+	Compressions     int64        `json:"compressions"`   // Used for this image.
+	SSIM             float64      `json:"ssim,omitempty"` // Only with --min-ssim.
+	PSNR             float64      `json:"psnr,omitempty"`
+	LowQuality       bool         `json:"low_quality,omitempty"` // Below --min-ssim, but kept anyway.
+	Background       string       `json:"background,omitempty"`  // Picked with --background auto.
+	Placeholder      *placeholder `json:"placeholder,omitempty"` // Only with --placeholder.
+	Duration         float64      `json:"duration_seconds"`
+	Error            string       `json:"error,omitempty"`
+	Skipped          string       `json:"skipped,omitempty"` // Why the image was not processed, if it wasn't.
+	Snippet          string       `json:"snippet,omitempty"`
+	started          time.Time    // When processing started.
+}
+
+var (
+	current *record  // Image being processed right now, if any.
+	records []record // All finished records, for the final JSON report.
+)
+
+// beginRecord starts a record for a new image. The output is provisional, and
+// will only be known for sure after calling the API.
+func beginRecord(input, output string) {
+	if len(input) == 0 {
+		input = "-"
+	}
+	if (len(output) == 0 || output == "-") && len(setting.OutputTemplate) == 0 {
+		output = "-"
+	}
+	current = &record{
+		Operation: setting.Operation,
+		Input:     input,
+		Output:    output,
+		started:   time.Now(),
+	}
+}
+
+// resultRecord fills in the current record with what the API returned, and
+// with the output filename (empty for STDOUT).
+func resultRecord(source *Tinify.Source, result *Tinify.Result, output string) {
+	if current == nil {
+		return
+	}
+	if len(output) == 0 {
+		output = "-"
+	}
+	stats := result.Stats()
+	// For URLs, only the API knows the size of the original.
+	if current.BytesBefore == 0 {
+		current.BytesBefore = stats.InputSize
+	}
+	current.Output = output
+	current.BytesAfter = stats.OutputSize
+	if current.BytesBefore > 0 {
+		current.Savings = float64(current.BytesBefore-current.BytesAfter) * 100 / float64(current.BytesBefore)
+	}
+	current.Width = result.Width()
+	current.Height = result.Height()
+	current.MediaType = result.MediaType()
+	current.CompressionCount = result.CompressionCount()
+	current.Compressions = compressionsFor(setting.Operation)
+}
+
+// endRecord finishes the current record, adding the error (if any), and emits it.
+// Dry runs do not produce any records, since nothing was done.
+func endRecord(err error) {
+	if current == nil {
+		return
+	}
+	rec := *current
+	current = nil
+
+	if errors.Is(err, errDryRun) || setting.DryRun {
+		return
+	}
+	var skip *skipError
+	switch {
+	case errors.As(err, &skip):
+		if skip.quiet {
+			return
+		}
+		rec.Skipped = skip.reason
+		if len(skip.output) > 0 {
+			rec.Output = skip.output
+		}
+	case err != nil:
+		rec.Error = err.Error()
+	}
+	rec.Duration = time.Since(rec.started).Seconds()
+	summaryRecords = append(summaryRecords, rec)
+
+	switch setting.OutputFormat {
+	case "":
+		// No reports.
+	case "json":
+		// Written all at once, at the end.
+		records = append(records, rec)
+	case "ndjson":
+		encoder := json.NewEncoder(reportWriter(rec.Output))
+		encoder.SetEscapeHTML(false) // keep snippets readable.
+		if err := encoder.Encode(rec); err != nil {
+			setting.Logger.Error().Msgf("endRecord: could not write record: %s", err)
+		}
+	default:
+		printRecord(reportWriter(rec.Output), rec)
+	}
+}
+
+// printRecord writes a human-readable version of a record.
+func printRecord(w io.Writer, rec record) {
+	if len(rec.Error) > 0 {
+		fmt.Fprintf(w, "%s: %s failed: %s\n", rec.Input, rec.Operation, rec.Error)
+		return
+	}
+	if len(rec.Skipped) > 0 {
+		fmt.Fprintf(w, "%s -> %s: skipped (%s)\n", rec.Input, rec.Output, rec.Skipped)
+		return
+	}
+	fmt.Fprintf(w, "%s -> %s: %d -> %d byte(s) (%.1f%% saved), %dx%d %s, %.2fs, compression count: %d\n",
+		rec.Input, rec.Output, rec.BytesBefore, rec.BytesAfter, rec.Savings,
+		rec.Width, rec.Height, rec.MediaType, rec.Duration, rec.CompressionCount)
+	if rec.SSIM > 0 {
+		fmt.Fprintf(w, "  SSIM: %.4f, PSNR: %.2f dB", rec.SSIM, rec.PSNR)
+		if rec.LowQuality {
+			fmt.Fprint(w, " (low quality)")
+		}
+		fmt.Fprintln(w)
+	}
+	if len(rec.Background) > 0 {
+		fmt.Fprintf(w, "  background: %s\n", rec.Background)
+	}
+	if rec.Placeholder != nil {
+		fmt.Fprintf(w, "  placeholder: %dx%d (%d-byte data URI), BlurHash %s, dominant colour %s\n", rec.Placeholder.Width, rec.Placeholder.Height,
+			len(rec.Placeholder.DataURI), rec.Placeholder.BlurHash, rec.Placeholder.DominantColour)
+	}
+	if len(rec.Snippet) > 0 {
+		fmt.Fprintln(w, rec.Snippet)
+	}
+}
+
+// printRecords writes all collected records as a JSON array, and forgets about them.
+func printRecords() error {
+	if setting.OutputFormat != "json" {
+		return nil
+	}
+	defer func() { records = nil }()
+	output := ""
+	for _, rec := range records {
+		if rec.Output == "-" {
+			output = "-"
+		}
+	}
+	encoder := json.NewEncoder(reportWriter(output))
+	encoder.SetIndent("", "\t")
+	encoder.SetEscapeHTML(false)
+	if records == nil {
+		// An empty array is nicer to parse than `null`.
+		records = []record{}
+	}
+	return encoder.Encode(records)
+}
+
+// printReports writes whatever is written at the end of a run: the JSON array of
+// records, if that's the format, and the summary.
+func printReports() {
+	if err := printRecords(); err != nil {
+		setting.Logger.Error().Msgf("could not write records: %s", err)
+	}
+	if err := printSummary(); err != nil {
+		setting.Logger.Error().Msgf("could not write summary: %s", err)
+	}
+}
+
+// reportWriter returns where reports go: STDOUT, unless that's where the image
+// went, in which case STDERR is used instead.
+func reportWriter(output string) io.Writer {
+	if output == "-" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// withRecord wraps a command action, so that its record is finished with whatever
+// error the action returned.
+func withRecord(action cli.ActionFunc) cli.ActionFunc {
+	return func(ctx context.Context, cmd *cli.Command) error {
+		err := action(ctx, cmd)
+		endRecord(err)
+		// Print them right now, since exiting with an error skips the `After` hooks.
+		printReports()
+		if isSkipped(err) {
+			// Reported already; it's not a failure.
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,90 @@
+// Tests for the per-image reports.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Checks that finished records are written as text, as one JSON object per line, or
+// collected for a final JSON array, and that skipped and failed images say so.
+func TestEndRecord(t *testing.T) {
+	saved := setting
+	defer func() { setting, current, records, summaryRecords = saved, nil, nil, nil }()
+
+	done := record{Operation: "compress", Input: "cat.png", Output: "cat.tiny.png", BytesBefore: 1000, BytesAfter: 250,
+		Savings: 75, Width: 80, Height: 60, MediaType: "image/png", CompressionCount: 42, Compressions: 1, Background: "#ffffff"}
+	var reportTests = []struct {
+		format string
+		err    error
+		want   []string // Substrings expected on STDOUT.
+	}{
+		{"text", nil, []string{"cat.png -> cat.tiny.png: 1000 -> 250 byte(s) (75.0% saved), 80x60 image/png", "compression count: 42\n", "  background: #ffffff\n"}},
+		{"text", errors.New("boom"), []string{"cat.png: compress failed: boom\n"}},
+		{"text", &skipError{reason: "already optimised"}, []string{"cat.png -> cat.tiny.png: skipped (already optimised)\n"}},
+		{"ndjson", nil, []string{`{"operation":"compress","input":"cat.png","output":"cat.tiny.png","bytes_before":1000,`, "}\n"}},
+		{"ndjson", errors.New("boom"), []string{`"error":"boom"`}},
+		{"json", nil, nil},
+		{"", nil, nil},
+	}
+	for _, tc := range reportTests {
+		setting.OutputFormat, setting.DryRun = tc.format, false
+		records, summaryRecords = nil, nil
+		current = &record{}
+		*current = done
+		got := captureStdout(t, func() { endRecord(tc.err) })
+		if current != nil {
+			t.Fatalf("%s: the record was not finished", tc.format)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Fatalf("%s, error %v: got %q, expected it to contain %q", tc.format, tc.err, got, want)
+			}
+		}
+		if len(tc.want) == 0 && len(got) > 0 {
+			t.Fatalf("%s: got %q, expected nothing until the end", tc.format, got)
+		}
+		if tc.format == "ndjson" && strings.Count(got, "\n") != 1 {
+			t.Fatalf("ndjson: got %q, expected a single line", got)
+		}
+		if len(summaryRecords) != 1 {
+			t.Fatalf("%s: %d record(s) kept for the summary, expected 1", tc.format, len(summaryRecords))
+		}
+	}
+
+	// JSON records are written all at once, as an array.
+	setting.OutputFormat = "json"
+	records = nil
+	for _, input := range []string{"a.png", "b.png"} {
+		current = &record{Operation: "compress", Input: input, Output: input}
+		endRecord(nil)
+	}
+	got := captureStdout(t, func() {
+		if err := printRecords(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	var array []record
+	if err := json.Unmarshal([]byte(got), &array); err != nil || len(array) != 2 || array[1].Input != "b.png" {
+		t.Fatalf("json: got %q (error %v), expected an array with both records", got, err)
+	}
+	if got = captureStdout(t, func() { printRecords() }); strings.TrimSpace(got) != "[]" {
+		t.Fatalf("json: got %q after printing, expected an empty array", got)
+	}
+
+	// Dry runs, and quietly skipped images, are not reported at all.
+	for _, tc := range []struct {
+		dryRun bool
+		err    error
+	}{{true, nil}, {false, errDryRun}, {false, &skipError{quiet: true}}} {
+		setting.DryRun = tc.dryRun
+		records, summaryRecords = nil, nil
+		current = &record{Input: "cat.png"}
+		endRecord(tc.err)
+		if len(records) > 0 || len(summaryRecords) > 0 {
+			t.Fatalf("dry run %t, error %v: got a record", tc.dryRun, tc.err)
+		}
+	}
+}
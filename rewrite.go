@@ -0,0 +1,376 @@
+// Rewriting of image references: finds the images used by HTML and Markdown files,
+// runs them through the API, and points the references to the optimised files.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Filename extensions of the documents searched for image references.
+var (
+	htmlExtensions     = []string{".html", ".htm"}
+	markdownExtensions = []string{".md", ".markdown"}
+)
+
+var (
+	// <img> and <source> tags (the latter being used inside <picture>).
+	reImageTag = regexp.MustCompile(`(?is)<(?:img|source)\b[^>]*>`)
+	// src and srcset attributes inside one of the tags above, either with double or single quotes.
+	reImageAttr = regexp.MustCompile(`(?is)\s(src|srcset)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	// Markdown images: ![alt](url "optional title"), or ![alt](<url> "optional title"),
+	// which allows spaces in the URL.
+	reMarkdownImage = regexp.MustCompile(`!\[[^\]]*\]\(\s*(?:<([^>\n]+)>|([^\s)]+))(?:\s+(?:"[^"]*"|'[^']*'))?\s*\)`)
+)
+
+// imageRef is a reference to an image, i.e., an URL, somewhere inside a document.
+type imageRef struct {
+	start, end int    // Position of the URL inside the document.
+	url        string // The URL itself, as written.
+}
+
+// rewriter keeps track of what has been processed so far, since the same image
+// is often referenced by many documents.
+type rewriter struct {
+	root    string            // Root of the site, for URLs starting with "/".
+	outputs map[string]string // Processed images, by absolute path or URL; empty if it failed.
+}
+
+// rewrite is the action for the `rewrite` command.
+func rewrite(ctx context.Context, cmd *cli.Command) error {
+	var err error // declared here due to scope issues.
+
+	if len(setting.SiteDir) == 0 {
+		return fmt.Errorf("rewrite: no site directory given")
+	}
+	if err = checkOperation(setting.Operation, &setting); err != nil {
+		return err
+	}
+	if setting.SiteDir, err = filepath.Abs(setting.SiteDir); err != nil {
+		return err
+	}
+	// Both relative to the site root, if not absolute.
+	if !filepath.IsAbs(setting.RemoteDir) {
+		setting.RemoteDir = filepath.Join(setting.SiteDir, setting.RemoteDir)
+	}
+	if len(setting.OutputTemplate) == 0 {
+		setting.OutputTemplate = "{dir}/{name}.tiny.{ext}"
+		if setting.HashNames {
+			setting.OutputTemplate = "{dir}/{name}.{hash8}.{ext}"
+		}
+	}
+
+	// Unless told otherwise, the ledger is kept at the root of the site.
+	if activeLedger == nil {
+		if activeLedger, err = openLedger(filepath.Join(setting.SiteDir, ledgerFileName)); err != nil {
+			return err
+		}
+	}
+
+	// Whatever was processed so far gets reported, even if something fails.
+	defer printReports()
+
+	rw := &rewriter{
+		root:    setting.SiteDir,
+		outputs: make(map[string]string),
+	}
+	return filepath.WalkDir(setting.SiteDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != setting.SiteDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !slices.Contains(htmlExtensions, ext) && !slices.Contains(markdownExtensions, ext) {
+			return nil
+		}
+		return rw.rewriteDocument(ctx, cmd, path, slices.Contains(markdownExtensions, ext))
+	})
+}
+
+// rewriteDocument processes all images referenced by one document, and rewrites
+// the references; in dry-run mode, the changes are printed as a diff instead.
+func (rw *rewriter) rewriteDocument(ctx context.Context, cmd *cli.Command, doc string, markdown bool) error {
+	data, err := os.ReadFile(doc)
+	if err != nil {
+		return err
+	}
+	content := string(data)
+	refs := findImageRefs(content, markdown)
+	setting.Logger.Debug().Msgf("rewrite: %q has %d image reference(s)", doc, len(refs))
+
+	// Replacements are done backwards, so that the positions stay valid.
+	rewritten := content
+	for _, ref := range slices.Backward(refs) {
+		newURL := rw.rewriteURL(ctx, cmd, doc, ref.url)
+		if len(newURL) == 0 || newURL == ref.url {
+			continue
+		}
+		rewritten = rewritten[:ref.start] + newURL + rewritten[ref.end:]
+	}
+	if rewritten == content {
+		return nil
+	}
+
+	if setting.DryRun {
+		printLineDiff(os.Stdout, doc, content, rewritten)
+		return nil
+	}
+	if err = writeFileAtomic(doc, []byte(rewritten)); err != nil {
+		return err
+	}
+	setting.Logger.Info().Msgf("rewrite: updated %q", doc)
+	return nil
+}
+
+// rewriteURL returns the URL that should replace the given one, processing the
+// image if needed; an empty string means that it should be left alone.
+func (rw *rewriter) rewriteURL(ctx context.Context, cmd *cli.Command, doc, ref string) string {
+	if strings.HasPrefix(ref, "data:") {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		setting.Logger.Debug().Msgf("rewrite: ignoring invalid URL %q on %q", ref, doc)
+		return ""
+	}
+	if !slices.Contains(watchExtensions, strings.ToLower(path.Ext(u.Path))) {
+		return ""
+	}
+
+	// Remote images get downloaded to the remote directory, and are referenced
+	// with a path relative to the document.
+	if u.IsAbs() || len(u.Host) > 0 {
+		if !setting.IncludeRemote || isRewriteOutput(u.Path, "") {
+			return ""
+		}
+		if len(u.Scheme) == 0 {
+			u.Scheme = "https" // protocol-relative URL.
+		}
+		output := rw.process(ctx, cmd, u.String(), true)
+		if len(output) == 0 {
+			return ""
+		}
+		rel, err := filepath.Rel(filepath.Dir(doc), output)
+		if err != nil {
+			return ""
+		}
+		return keepPlaceholders((&url.URL{Path: filepath.ToSlash(rel)}).EscapedPath())
+	}
+
+	// Local images are either relative to the site root, or to the document.
+	image := filepath.Join(filepath.Dir(doc), filepath.FromSlash(u.Path))
+	if strings.HasPrefix(u.Path, "/") {
+		image = filepath.Join(rw.root, filepath.FromSlash(u.Path))
+	}
+	if isRewriteOutput(u.Path, image) {
+		return ""
+	}
+	output := rw.process(ctx, cmd, image, false)
+	if len(output) == 0 {
+		return ""
+	}
+	// Keep the URL as written, just replacing whatever refers to the image itself.
+	rel, err := filepath.Rel(filepath.Dir(image), output)
+	if err != nil {
+		return ""
+	}
+	newPath := path.Join(path.Dir(u.Path), filepath.ToSlash(rel))
+	if strings.HasPrefix(u.Path, "./") {
+		newPath = "./" + newPath
+	}
+	u.Path, u.RawPath = newPath, ""
+	return keepPlaceholders(u.String())
+}
+
+// keepPlaceholders undoes the escaping of the placeholders left on dry runs (e.g. {hash8}),
+// so that they are easier to read on the diff.
+func keepPlaceholders(u string) string {
+	if !setting.DryRun {
+		return u
+	}
+	return strings.NewReplacer("%7B", "{", "%7D", "}").Replace(u)
+}
+
+// process runs an image through the API, once, and returns the path to the output,
+// or an empty string if it failed.
+func (rw *rewriter) process(ctx context.Context, cmd *cli.Command, image string, remote bool) string {
+	if output, ok := rw.outputs[image]; ok {
+		return output
+	}
+	output, err := rw.processImage(ctx, cmd, image, remote)
+	if err != nil {
+		setting.Logger.Error().Msgf("rewrite: processing %q failed: %s", image, err)
+	}
+	endRecord(err)
+	rw.outputs[image] = output
+	return output
+}
+
+// processImage does the actual work for process.
+func (rw *rewriter) processImage(ctx context.Context, cmd *cli.Command, image string, remote bool) (string, error) {
+	tmpl := setting.OutputTemplate
+	if remote {
+		tmpl = strings.ReplaceAll(tmpl, "{dir}", setting.RemoteDir)
+		if _, err := os.Stat(setting.RemoteDir); err != nil && setting.DryRun {
+			// Nothing can be checked until the directory exists, and it won't be created on a dry run.
+			addPlanItem(image, plannedOutput(tmpl, image), "", 0)
+			return plannedOutput(tmpl, image), nil
+		}
+		if err := os.MkdirAll(setting.RemoteDir, 0755); err != nil {
+			return "", err
+		}
+	} else if _, err := os.Stat(image); err != nil {
+		// Missing images are left alone (openStream would otherwise read from STDIN).
+		return "", err
+	}
+
+	// The template is changed just for this image.
+	defer func(t string) { setting.OutputTemplate = t }(setting.OutputTemplate)
+	setting.OutputTemplate = tmpl
+	setting.ImageName = image
+	setting.OutputFileName = ""
+
+	setting.Logger.Info().Msgf("rewrite: processing %q", image)
+
+	var skip *skipError
+	ctx, source, err := openStream(ctx)
+	if errors.Is(err, errDryRun) {
+		return plannedOutput(tmpl, image), nil
+	} else if errors.As(err, &skip) {
+		// Processed before; the references may still need to be rewritten, though.
+		return skip.output, nil
+	} else if err != nil {
+		return "", err
+	}
+	if err = applyOperation(source, setting.Operation, &setting, originalImage); err != nil {
+		return "", err
+	}
+	if err = callAPI(ctx, cmd, source); errors.As(err, &skip) {
+		// Not worth it; the original was kept, maybe under the output filename.
+		endRecord(err)
+		if len(skip.output) == 0 {
+			return "", nil
+		}
+		return filepath.Abs(skip.output)
+	} else if err != nil {
+		return "", err
+	}
+	return filepath.Abs(setting.LastOutput)
+}
+
+// plannedOutput figures out the output filename in dry-run mode, without a result.
+// The extension is guessed from the requested type; placeholders such as {hash8},
+// which can only be known after calling the API, are left as they are.
+func plannedOutput(tmpl, image string) string {
+	_, _, ext := splitInputName(image)
+	if setting.Operation == "convert" && !strings.Contains(setting.FileType, ",") && len(setting.FileType) > 0 {
+		ext = extensionFromMediaType("image/" + setting.FileType)
+	}
+	output := strings.ReplaceAll(expandOutputTemplate(tmpl, image, nil), "{ext}", ext)
+	if abs, err := filepath.Abs(output); err == nil {
+		return abs
+	}
+	return output
+}
+
+// isRewriteOutput checks if a reference already points to one of our outputs, following
+// the default naming, so that running `rewrite` twice does not process them again. Any
+// name may end with 8 hex digits (e.g. logo.deadbeef.png), so these only count if they
+// match the hash of the local file, as {hash8} does; remote images never do.
+func isRewriteOutput(p, file string) bool {
+	name := strings.TrimSuffix(path.Base(p), path.Ext(p))
+	suffix := path.Ext(name)
+	if suffix == ".tiny" {
+		return true
+	}
+	if len(suffix) != 9 || !isValidHex(suffix[1:]) || len(file) == 0 {
+		return false
+	}
+	data, err := os.ReadFile(file)
+	return err == nil && strings.EqualFold(hashBytes(data)[:8], suffix[1:])
+}
+
+// findImageRefs returns all references to images inside a document, in order.
+// Markdown documents may also include HTML.
+func findImageRefs(content string, markdown bool) []imageRef {
+	var refs []imageRef
+	for _, tag := range reImageTag.FindAllStringIndex(content, -1) {
+		for _, m := range reImageAttr.FindAllStringSubmatchIndex(content[tag[0]:tag[1]], -1) {
+			// Either the double-quoted or the single-quoted value matched.
+			start, end := m[4], m[5]
+			if start < 0 {
+				start, end = m[6], m[7]
+			}
+			start, end = start+tag[0], end+tag[0]
+			if strings.EqualFold(content[tag[0]+m[2]:tag[0]+m[3]], "src") {
+				if value := strings.TrimSpace(content[start:end]); len(value) > 0 {
+					offset := strings.Index(content[start:end], value)
+					refs = append(refs, imageRef{start + offset, start + offset + len(value), value})
+				}
+				continue
+			}
+			refs = append(refs, srcsetRefs(content[start:end], start)...)
+		}
+	}
+	if markdown {
+		for _, m := range reMarkdownImage.FindAllStringSubmatchIndex(content, -1) {
+			start, end := m[2], m[3]
+			if start < 0 {
+				start, end = m[4], m[5]
+			}
+			refs = append(refs, imageRef{start, end, content[start:end]})
+		}
+		slices.SortFunc(refs, func(a, b imageRef) int { return a.start - b.start })
+	}
+	return refs
+}
+
+// srcsetRefs splits a srcset attribute into its candidates, e.g. "a.jpg 1x, b.jpg 2x",
+// and returns the references for each of them; offset is the position of the attribute.
+func srcsetRefs(srcset string, offset int) []imageRef {
+	var refs []imageRef
+	pos := 0
+	for candidate := range strings.SplitSeq(srcset, ",") {
+		trimmed := strings.TrimLeft(candidate, " \t\r\n")
+		start := pos + len(candidate) - len(trimmed)
+		u := trimmed
+		if i := strings.IndexFunc(trimmed, unicode.IsSpace); i >= 0 {
+			u = trimmed[:i]
+		}
+		if len(u) > 0 {
+			refs = append(refs, imageRef{offset + start, offset + start + len(u), u})
+		}
+		pos += len(candidate) + 1 // the comma.
+	}
+	return refs
+}
+
+// printLineDiff writes a minimal unified diff (without context) between two versions
+// of a document. Since only URLs get replaced, both have the same number of lines.
+func printLineDiff(w io.Writer, name, before, after string) {
+	oldLines, newLines := strings.Split(before, "\n"), strings.Split(after, "\n")
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", name, name)
+	for i := range min(len(oldLines), len(newLines)) {
+		if oldLines[i] != newLines[i] {
+			fmt.Fprintf(w, "@@ -%d +%d @@\n-%s\n+%s\n", i+1, i+1, oldLines[i], newLines[i])
+		}
+	}
+}
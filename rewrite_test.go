@@ -0,0 +1,157 @@
+// Tests for `rewrite`.
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Checks that image references are found on <img> and <source> elements (both src and
+// srcset) and, in Markdown documents, on ![]() too, in order and at the right positions.
+func TestFindImageRefs(t *testing.T) {
+	var refTests = []struct {
+		content  string
+		markdown bool
+		want     []string
+	}{
+		{`<img alt="x" src="a.jpg">`, false, []string{"a.jpg"}},
+		{`<IMG SRC='a.jpg' srcset="b.jpg 1x,  c.jpg 2x">`, false, []string{"a.jpg", "b.jpg", "c.jpg"}},
+		{`<source srcset="b.webp">`, false, []string{"b.webp"}},
+		{`<a href="a.jpg">![x](b.png "title")</a>`, false, nil},
+		{`![x](b.png "title") and <img src="a.jpg"> and ![](<c d.png>)`, true, []string{"b.png", "a.jpg", "c d.png"}},
+	}
+
+	for _, tc := range refTests {
+		var got []string
+		for _, ref := range findImageRefs(tc.content, tc.markdown) {
+			if tc.content[ref.start:ref.end] != ref.url {
+				t.Fatalf("reference %q on %q is at the wrong position", ref.url, tc.content)
+			}
+			got = append(got, ref.url)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Fatalf("references on %q were %q, expected %q", tc.content, got, tc.want)
+		}
+	}
+}
+
+// Checks which references count as outputs of rewrite: .tiny names, and names ending
+// with the first 8 hex digits of the hash of the file, but not any 8 hex digits.
+func TestIsRewriteOutput(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("tiny")
+	hash8 := hashBytes(data)[:8]
+	for _, name := range []string{"logo." + hash8 + ".png", "logo.deadbeef.png"} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var outputTests = []struct {
+		ref, file string
+		want      bool
+	}{
+		{"img/logo.tiny.png", "", true},
+		{"img/logo.png", filepath.Join(dir, "logo.png"), false},
+		{"img/logo." + hash8 + ".png", filepath.Join(dir, "logo."+hash8+".png"), true},
+		{"img/logo." + strings.ToUpper(hash8) + ".png", filepath.Join(dir, "logo."+hash8+".png"), true},
+		{"img/logo.deadbeef.png", filepath.Join(dir, "logo.deadbeef.png"), false},
+		{"img/logo." + hash8 + ".png", filepath.Join(dir, "missing.png"), false},
+		{"https://example.com/logo." + hash8 + ".png", "", false},
+		{"img/logo.cafe.png", filepath.Join(dir, "logo.cafe.png"), false},
+	}
+	for _, tc := range outputTests {
+		if got := isRewriteOutput(tc.ref, tc.file); got != tc.want {
+			t.Fatalf("%q (%q): got %t, expected %t", tc.ref, tc.file, got, tc.want)
+		}
+	}
+}
+
+// Checks, through a fake API, that rewriting a site processes each local image once,
+// points the references to the hashed outputs, and leaves external URLs alone; on a
+// second run, nothing is uploaded, and references to the originals are resolved
+// through the ledger.
+func TestRewrite(t *testing.T) {
+	saved, savedLedger := setting, activeLedger
+	defer func() { setting, activeLedger, current, records, summaryRecords = saved, savedLedger, nil, nil, nil }()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	api := useFakeAPI(t)
+
+	site := filepath.Join(dir, "site")
+	write := func(name string, data []byte) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(site, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(site, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(site, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	images := make(map[string]string) // Hashed names, as {hash8} makes them.
+	for i, name := range []string{"logo", "big"} {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4+i, 4))); err != nil {
+			t.Fatal(err)
+		}
+		write("img/"+name+".png", buf.Bytes())
+		images[name] = name + "." + hashBytes(buf.Bytes())[:8] + ".png"
+	}
+	write("index.html", []byte(`<img src="img/logo.png" srcset="img/logo.png 1x, img/big.png 2x"><img src="https://example.com/a.png">`))
+	write("posts/post.md", []byte(`![Logo](/img/logo.png "Logo")`))
+
+	run := func() {
+		t.Helper()
+		setting.SiteDir, setting.RemoteDir, setting.IncludeRemote, setting.HashNames = site, "remote", false, true
+		setting.Operation, setting.OutputTemplate, setting.Mark = "compress", "", false
+		setting.DryRun, setting.Force, setting.OutputFormat, setting.SummaryFormat = false, false, "", "none"
+		setting.MinSavings, setting.MinSSIM = 0, 0
+		activeLedger = nil
+		if err := rewrite(context.Background(), &cli.Command{Name: "rewrite"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run()
+
+	wantHTML := `<img src="img/` + images["logo"] + `" srcset="img/` + images["logo"] + ` 1x, img/` + images["big"] + ` 2x"><img src="https://example.com/a.png">`
+	wantMarkdown := `![Logo](/img/` + images["logo"] + ` "Logo")`
+	if got := read("index.html"); got != wantHTML {
+		t.Fatalf("index.html rewritten as %q, expected %q", got, wantHTML)
+	}
+	if got := read("posts/post.md"); got != wantMarkdown {
+		t.Fatalf("post.md rewritten as %q, expected %q", got, wantMarkdown)
+	}
+	if api.Uploads() != 2 {
+		t.Fatalf("%d image(s) uploaded, expected each of them just once", api.Uploads())
+	}
+
+	// A new document, still referring to an original, gets the output which is on the ledger.
+	write("new.html", []byte(`<img src="img/big.png">`))
+	run()
+	if got := read("index.html"); got != wantHTML {
+		t.Fatalf("index.html rewritten again as %q", got)
+	}
+	if got := read("new.html"); got != `<img src="img/`+images["big"]+`">` {
+		t.Fatalf("new.html rewritten as %q", got)
+	}
+	if api.Uploads() != 2 {
+		t.Fatalf("%d image(s) uploaded on the second run", api.Uploads()-2)
+	}
+}
@@ -0,0 +1,90 @@
+// Minimum savings: results which are barely smaller than the original (or even
+// larger, which happens after some conversions) are dropped, and the original kept.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+)
+
+// The image being processed right now, as read by openStream; nil for URLs.
+var originalImage []byte
+
+// parseMinSavings parses a percentage such as "5%", or just "5".
+func parseMinSavings(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%")), 64)
+	if err != nil || percent < 0 || percent >= 100 {
+		return 0, fmt.Errorf("invalid minimum savings %q; expected a percentage between 0 and 100, e.g. 5%%", s)
+	}
+	return percent, nil
+}
+
+// checkGain returns a *skipError if the result does not save enough to be worth keeping,
+// after writing the original image wherever the result would have gone (see keepOriginal).
+func checkGain(source *Tinify.Source, result *Tinify.Result, output string) error {
+	threshold := Tinify.Threshold{
+		Percent: setting.MinSavings,
+		Bytes:   setting.MinSavingsBytes,
+	}
+	stats := result.Stats()
+	if threshold.Met(stats) {
+		return nil
+	}
+	setting.Logger.Info().Msgf("checkGain: %q saved just %d byte(s) (%.1f%%); keeping the original", setting.ImageName, stats.Saved(), stats.Savings())
+	return keepOriginal(source, result, output, "insufficient gain")
+}
+
+// keepOriginal drops the result, writing the original image wherever the result would
+// have gone instead, and returns a *skipError with the reason. If the result is not even
+// of the same type as the original (as the API saw it, since not all types can be
+// sniffed locally), there is nowhere to write it to, and the original is just left
+// where it is.
+func keepOriginal(source *Tinify.Source, result *Tinify.Result, output, reason string) error {
+	skip := &skipError{reason: reason, output: output}
+	switch {
+	case originalImage == nil:
+		// Only the API has seen it.
+		setting.Logger.Warn().Msgf("keepOriginal: the original %q is remote, so nothing was written", setting.ImageName)
+		skip.output = ""
+	case originalType(source) != result.MediaType():
+		skip.output = setting.ImageName
+	default:
+		if err := passThrough(originalImage, output); err != nil {
+			return err
+		}
+		if activeLedger != nil && len(output) > 0 {
+			if err := activeLedger.record(output, originalImage); err != nil {
+				setting.Logger.Error().Msgf("keepOriginal: could not update the ledger: %s", err)
+			}
+		}
+	}
+	return skip
+}
+
+// originalType returns the media type of the original image, as reported by the API
+// when it was uploaded, or else as sniffed from its contents.
+func originalType(source *Tinify.Source) string {
+	if source != nil && len(source.Shrink().Input.Type) > 0 {
+		return source.Shrink().Input.Type
+	}
+	return detectMediaType(originalImage)
+}
+
+// passThrough writes the original image, unchanged, to output, unless that's where it
+// came from; with no output, it goes to STDOUT.
+func passThrough(data []byte, output string) error {
+	if len(output) == 0 {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	input, _ := filepath.Abs(setting.ImageName)
+	if abs, _ := filepath.Abs(output); abs == input {
+		return nil
+	}
+	return writeFileAtomic(output, data)
+}
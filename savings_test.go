@@ -0,0 +1,128 @@
+// Tests for --min-savings and --min-savings-bytes.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Checks the parsing of --min-savings.
+func TestMinSavings(t *testing.T) {
+	var parseTests = []struct {
+		s    string
+		want float64
+		ok   bool
+	}{
+		{"5%", 5, true},
+		{" 12.5 % ", 12.5, true},
+		{"0", 0, true},
+		{"100%", 0, false},
+		{"-1", 0, false},
+		{"five", 0, false},
+	}
+	for _, tc := range parseTests {
+		got, err := parseMinSavings(tc.s)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Fatalf("parsed %q and got %v (error: %v), expected %v", tc.s, got, err, tc.want)
+		}
+	}
+}
+
+// Checks that results which do not save enough are dropped, through a fake API which
+// returns the images as they were uploaded: the original is written instead, or just
+// left where it is, when processing in place or converting.
+func TestCheckGain(t *testing.T) {
+	saved, savedLedger := setting, activeLedger
+	defer func() { setting, activeLedger, current, records, summaryRecords = saved, savedLedger, nil, nil, nil }()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	useFakeAPI(t)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+	input := filepath.Join(dir, "cat.png")
+
+	var gainTests = []struct {
+		operation  string
+		minSavings float64
+		output     string // Where the image goes; empty to process it in place.
+		want       string // What ends up there: the "result", the "original", or "nothing".
+		skipped    bool
+	}{
+		{"compress", 0, "out.png", "result", false},
+		{"compress", 5, "out.png", "original", true},
+		{"compress", 5, "", "original", true},
+		{"convert", 5, "out.webp", "nothing", true},
+	}
+	for _, tc := range gainTests {
+		if err := os.WriteFile(input, original, 0644); err != nil {
+			t.Fatal(err)
+		}
+		output := input
+		if len(tc.output) > 0 {
+			output = filepath.Join(dir, tc.output)
+			os.Remove(output)
+		}
+		var err error
+		if activeLedger, err = openLedger(filepath.Join(t.TempDir(), ledgerFileName)); err != nil {
+			t.Fatal(err)
+		}
+		setting.ImageName, setting.OutputFileName, setting.OutputTemplate, setting.FileType = input, output, "", "webp"
+		setting.MinSavings, setting.MinSavingsBytes, setting.MinSSIM, setting.Mark = tc.minSavings, 0, 0, true
+		setting.EachType, setting.DryRun, setting.Force, setting.OutputFormat, setting.SummaryFormat = false, false, false, "json", "none"
+
+		action := compress
+		if tc.operation == "convert" {
+			action = convert
+		}
+		cmd := &cli.Command{
+			Name:   tc.operation,
+			Flags:  []cli.Flag{&cli.StringFlag{Name: "type", Destination: &setting.FileType}},
+			Action: withRecord(action),
+		}
+		report := captureStdout(t, func() { err = cmd.Run(context.Background(), []string{tc.operation}) })
+		if err != nil {
+			t.Fatalf("%+v: %s", tc, err)
+		}
+		var recs []record
+		if err = json.Unmarshal([]byte(report), &recs); err != nil || len(recs) != 1 {
+			t.Fatalf("%+v: expected one record, got %q (%v)", tc, report, err)
+		}
+		if skipped := recs[0].Skipped == "insufficient gain"; skipped != tc.skipped {
+			t.Fatalf("%+v: got record %+v", tc, recs[0])
+		}
+
+		data, err := os.ReadFile(output)
+		_, marked := findMarker(data)
+		got := "nothing"
+		switch {
+		case err != nil:
+		case bytes.Equal(data, original):
+			got = "original"
+		case marked:
+			got = "result"
+		}
+		if got != tc.want {
+			t.Fatalf("%+v: got the %s at %q, expected the %s", tc, got, output, tc.want)
+		}
+		// Whatever was written is known to the ledger, so it won't be processed again.
+		if _, ok := activeLedger.outputs[output]; ok != (got != "nothing") {
+			t.Fatalf("%+v: ledger outputs are %+v", tc, activeLedger.outputs)
+		}
+		if data, _ := os.ReadFile(input); !bytes.Equal(data, original) {
+			t.Fatalf("%+v: the original was changed", tc)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// HTTP server mode: exposes the CLI operations as a local REST service, so that
+// other applications can use the Tinify API without having to hold the API key.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+)
+
+// Largest image accepted by the server, in bytes.
+const serveMaxUpload = 64 << 20
+
+// serve is the action for the `serve` command. It runs until the server fails.
+func serve(ctx context.Context, cmd *cli.Command) error {
+	// Make sure that the default client exists before the handlers start racing for it.
+	Tinify.GetClient()
+
+	server := &http.Server{
+		Addr:              setting.Listen,
+		Handler:           serveHandler(setting.Concurrency),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+	}
+
+	setting.Logger.Info().Msgf("serve: listening on %q", setting.Listen)
+	return server.ListenAndServe()
+}
+
+// serveHandler routes each operation to its handler, with at most concurrency
+// simultaneous API calls.
+func serveHandler(concurrency int) http.Handler {
+	semaphore := make(chan struct{}, concurrency)
+
+	mux := http.NewServeMux()
+	for _, operation := range operations {
+		handler := serveOperation(operation)
+		mux.HandleFunc("POST /"+operation, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-r.Context().Done():
+				return
+			}
+			handler(w, r)
+		})
+	}
+	return mux
+}
+
+// serveOperation returns the handler for one of the operations.
+func serveOperation(operation string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Each request gets its own copy of the settings, since they may run concurrently.
+		s, err := settingFromQuery(r.URL.Query())
+		if err == nil {
+			s.Operation = operation
+			err = checkOperation(operation, &s)
+		}
+		if err != nil {
+			serveError(w, http.StatusBadRequest, "BadRequest", err)
+			return
+		}
+
+		rawImage, err := readServeImage(w, r)
+		if err != nil {
+			serveError(w, http.StatusBadRequest, "InputMissing", err)
+			return
+		}
+		if mimeType := detectMediaType(rawImage); !isSupportedMediaType(mimeType) {
+			serveError(w, http.StatusUnsupportedMediaType, "UnsupportedMediaType",
+				fmt.Errorf("invalid or not recognised Media Type %q", mimeType))
+			return
+		}
+
+		source, err := Tinify.FromBuffer(rawImage)
+		if err != nil {
+			serveError(w, http.StatusBadGateway, "UpstreamError", err)
+			return
+		}
+		if err = applyOperation(source, operation, &s, rawImage); err != nil {
+			serveError(w, http.StatusBadRequest, "BadRequest", err)
+			return
+		}
+		result, err := source.Result()
+		if err != nil {
+			serveError(w, http.StatusBadGateway, "UpstreamError", err)
+			return
+		}
+
+		header := w.Header()
+		header.Set("Content-Type", result.MediaType())
+		header.Set("Content-Length", strconv.Itoa(len(result.Data())))
+		header.Set("Image-Width", strconv.FormatInt(result.Width(), 10))
+		header.Set("Image-Height", strconv.FormatInt(result.Height(), 10))
+		header.Set("Compression-Count", strconv.FormatInt(result.CompressionCount(), 10))
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(result.Data()); err != nil {
+			setting.Logger.Error().Msgf("serve: %s %s: writing response failed: %s", r.Method, r.URL.Path, err)
+			return
+		}
+
+		setting.Logger.Info().Msgf("serve: %s %s: %d -> %d byte(s) in %s, compression count: %d",
+			r.Method, r.URL.Path, len(rawImage), len(result.Data()), time.Since(start), result.CompressionCount())
+	}
+}
+
+// settingFromQuery builds a copy of the global settings, overriding them with
+// the operation parameters in the query string, after validating them.
+func settingFromQuery(query url.Values) (Setting, error) {
+	s := setting
+	// Same defaults as the command-line flags.
+	s.Method = Tinify.ResizeMethodScale
+	s.FileType = "webp"
+
+	if method := query.Get("method"); len(method) > 0 {
+		if !slices.Contains(methods, method) {
+			return s, fmt.Errorf("invalid resize method: %q", method)
+		}
+		s.Method = method
+	}
+	for name, dest := range map[string]*int64{"width": &s.Width, "height": &s.Height} {
+		if value := query.Get(name); len(value) > 0 {
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || i < 1 {
+				return s, fmt.Errorf("%s must be at least 1, %q provided", name, value)
+			}
+			*dest = i
+		}
+	}
+	if fileType := strings.ToLower(query.Get("type")); len(fileType) > 0 {
+		if err := checkFileTypes(fileType); err != nil {
+			return s, err
+		}
+		s.FileType = fileType
+	}
+	if background := strings.ToLower(query.Get("background")); len(background) > 0 {
+		if !isValidBackground(background) {
+			return s, fmt.Errorf("background colour: invalid hex value %q", background)
+		}
+		s.Transform = background
+	}
+	return s, nil
+}
+
+// readServeImage gets the image from the request, either from the raw body,
+// or from the first file in a multipart upload.
+func readServeImage(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, serveMaxUpload)
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		data, err := io.ReadAll(r.Body)
+		if err == nil && len(data) == 0 {
+			err = fmt.Errorf("empty request body")
+		}
+		return data, err
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no file found in multipart upload")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(part.FileName()) == 0 {
+			continue
+		}
+		data, err := io.ReadAll(part)
+		if err == nil && len(data) == 0 {
+			err = fmt.Errorf("empty file %q in multipart upload", part.FileName())
+		}
+		return data, err
+	}
+}
+
+// serveError sends back a JSONified error message, in the same format used by the Tinify API.
+func serveError(w http.ResponseWriter, status int, kind string, err error) {
+	setting.Logger.Error().Msgf("serve: %s: %s", kind, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Tinify.ErrorMessage{
+		Error:   kind,
+		Message: err.Error(),
+	})
+}
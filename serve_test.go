@@ -0,0 +1,100 @@
+// Tests for the HTTP server.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+)
+
+// Checks the responses of the HTTP server, for each operation (filling the background of
+// transparent images converted to JPEG), for invalid parameters and uploads, and when the
+// API fails.
+func TestServe(t *testing.T) {
+	saved := setting
+	defer func() { setting = saved }()
+	api := useFakeAPI(t)
+	server := httptest.NewServer(serveHandler(2))
+	defer server.Close()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	var upload bytes.Buffer
+	form := multipart.NewWriter(&upload)
+	part, err := form.CreateFormFile("image", "cat.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(img.Bytes())
+	form.Close()
+
+	// The image is transparent, so converting it to JPEG needs a background.
+	setting.JPEGBackground = "white"
+
+	var serveTests = []struct {
+		name, path, contentType string
+		body                    []byte
+		apiStatus               int // Returned by the API for all requests, if set.
+		status                  int
+		mediaType, width        string // Of the result, if successful.
+		background              string // Asked for, if any.
+	}{
+		{"compress", "/compress", "image/png", img.Bytes(), 0, http.StatusOK, "image/png", "4", ""},
+		{"resize", "/resize?method=fit&width=100&height=50", "image/png", img.Bytes(), 0, http.StatusOK, "image/png", "100", ""},
+		{"convert", "/convert?type=webp", "image/png", img.Bytes(), 0, http.StatusOK, "image/webp", "4", ""},
+		{"transform", "/transform?background=%23ff0000", "image/png", img.Bytes(), 0, http.StatusOK, "image/png", "4", "#ff0000"},
+		{"convert to JPEG", "/convert?type=jpeg", "image/png", img.Bytes(), 0, http.StatusOK, "image/jpeg", "4", "white"},
+		{"convert to JPEG, with a background", "/convert?type=jpeg&background=%23000080", "image/png", img.Bytes(), 0, http.StatusOK, "image/jpeg", "4", "#000080"},
+		{"multipart upload", "/compress", form.FormDataContentType(), upload.Bytes(), 0, http.StatusOK, "image/png", "4", ""},
+		{"fit without height", "/resize?method=fit&width=100", "image/png", img.Bytes(), 0, http.StatusBadRequest, "", "", ""},
+		{"invalid width", "/resize?width=-1", "image/png", img.Bytes(), 0, http.StatusBadRequest, "", "", ""},
+		{"unknown type", "/convert?type=bmp", "image/png", img.Bytes(), 0, http.StatusBadRequest, "", "", ""},
+		{"transform without background", "/transform", "image/png", img.Bytes(), 0, http.StatusBadRequest, "", "", ""},
+		{"empty body", "/compress", "image/png", nil, 0, http.StatusBadRequest, "", "", ""},
+		{"not an image", "/compress", "text/plain", []byte("hello, world"), 0, http.StatusUnsupportedMediaType, "", "", ""},
+		{"API failure", "/compress", "image/png", img.Bytes(), http.StatusTooManyRequests, http.StatusBadGateway, "", "", ""},
+		{"unknown operation", "/stretch", "image/png", img.Bytes(), 0, http.StatusNotFound, "", "", ""},
+	}
+	for _, tc := range serveTests {
+		api.Fail(tc.apiStatus)
+		backgrounds := len(api.Backgrounds())
+		response, err := http.Post(server.URL+tc.path, tc.contentType, bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != tc.status {
+			t.Fatalf("%s: got %s (%s), expected %d", tc.name, response.Status, data, tc.status)
+		}
+		switch {
+		case tc.status == http.StatusOK:
+			if got := response.Header.Get("Content-Type"); got != tc.mediaType || response.Header.Get("Image-Width") != tc.width || !bytes.Equal(data, img.Bytes()) {
+				t.Fatalf("%s: got a %d-byte %s, %s pixels wide, expected the image as %s, %s pixels wide",
+					tc.name, len(data), got, response.Header.Get("Image-Width"), tc.mediaType, tc.width)
+			}
+			var background string
+			if got := api.Backgrounds(); len(got) > backgrounds {
+				background = got[len(got)-1]
+			}
+			if background != tc.background {
+				t.Fatalf("%s: got background %q, expected %q", tc.name, background, tc.background)
+			}
+		case tc.status != http.StatusNotFound:
+			var message Tinify.ErrorMessage
+			if err = json.Unmarshal(data, &message); err != nil || len(message.Error) == 0 || len(message.Message) == 0 {
+				t.Fatalf("%s: got %q, expected a JSON error message", tc.name, data)
+			}
+		}
+	}
+}
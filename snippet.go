@@ -0,0 +1,180 @@
+// Ready-to-paste markup (HTML, JSX or Markdown) for the images written by the CLI,
+// with the intrinsic dimensions taken from what the API returned.
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Valid values for --snippet; empty means no snippet at all.
+var snippetFormats = []string{"picture", "img", "markdown", "jsx"}
+
+// Media types, from the most to the least desirable. Browsers use the first <source>
+// they support, so the more modern formats must come first; whatever comes last
+// is used for the <img> fallback.
+var snippetTypeOrder = []string{"image/avif", "image/webp", "image/png", "image/jpeg"}
+
+// snippetImage is one of the files to be referenced by a snippet.
+type snippetImage struct {
+	Path      string
+	Width     int64
+	Height    int64
+	MediaType string
+}
+
+// attribute is a single HTML attribute.
+type attribute struct {
+	name, value string
+}
+
+// emitSnippet builds the snippet for the given images, and reports it: together with
+// the record for the current image, if there is one, or else on its own. The snippet
+// is also returned, so that it can be added to other reports (e.g. srcset manifests).
+func emitSnippet(output string, images []snippetImage) string {
+	if len(setting.Snippet) == 0 || len(images) == 0 {
+		return ""
+	}
+	snippet := buildSnippet(setting.Snippet, images)
+	switch {
+	case current != nil && len(setting.OutputFormat) > 0:
+		current.Snippet = snippet
+	case len(setting.OutputFormat) == 0 || setting.OutputFormat == "text":
+		fmt.Fprintln(reportWriter(output), snippet)
+	}
+	return snippet
+}
+
+// buildSnippet returns the markup for the images, which may be several variants
+// (in width and/or type) of the same image.
+func buildSnippet(format string, images []snippetImage) string {
+	groups := groupByMediaType(images)
+	fallback := groups[len(groups)-1]
+	largest := fallback[len(fallback)-1]
+	alt := expandOutputTemplate(setting.SnippetAlt, setting.ImageName, nil)
+
+	if format == "markdown" {
+		// No srcset in Markdown; the best that can be done is the largest fallback.
+		alt = strings.NewReplacer("[", `\[`, "]", `\]`).Replace(alt)
+		return fmt.Sprintf("![%s](%s)", alt, snippetURL(largest.Path))
+	}
+
+	jsx := format == "jsx"
+	img := []attribute{
+		{"src", snippetURL(largest.Path)},
+	}
+	if len(fallback) > 1 {
+		img = append(img, srcsetAttributes(fallback, jsx)...)
+	}
+	img = append(img,
+		attribute{"width", strconv.FormatInt(largest.Width, 10)},
+		attribute{"height", strconv.FormatInt(largest.Height, 10)},
+		attribute{"alt", alt},
+	)
+	if setting.SnippetLazy {
+		img = append(img, attribute{"loading", "lazy"}, attribute{"decoding", "async"})
+	}
+
+	if format == "img" {
+		return element("img", img, jsx)
+	}
+
+	// <picture>, either as HTML or as JSX.
+	var b strings.Builder
+	b.WriteString("<picture>\n")
+	for _, group := range groups[:len(groups)-1] {
+		attrs := append([]attribute{{"type", group[0].MediaType}}, srcsetAttributes(group, jsx)...)
+		b.WriteString("  " + element("source", attrs, jsx) + "\n")
+	}
+	b.WriteString("  " + element("img", img, jsx) + "\n")
+	b.WriteString("</picture>")
+	return b.String()
+}
+
+// groupByMediaType splits the images by media type, following snippetTypeOrder,
+// with each group sorted by width.
+func groupByMediaType(images []snippetImage) [][]snippetImage {
+	byType := make(map[string][]snippetImage)
+	for _, img := range images {
+		byType[img.MediaType] = append(byType[img.MediaType], img)
+	}
+	mediaTypes := slices.Collect(maps.Keys(byType))
+	slices.SortFunc(mediaTypes, func(a, b string) int {
+		return cmp.Or(cmp.Compare(snippetTypeRank(a), snippetTypeRank(b)), strings.Compare(a, b))
+	})
+
+	groups := make([][]snippetImage, 0, len(mediaTypes))
+	for _, mediaType := range mediaTypes {
+		group := byType[mediaType]
+		slices.SortStableFunc(group, func(a, b snippetImage) int {
+			return cmp.Compare(a.Width, b.Width)
+		})
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// snippetTypeRank returns the position of the media type in snippetTypeOrder;
+// unknown types go last, since browsers are unlikely to support them.
+func snippetTypeRank(mediaType string) int {
+	if i := slices.Index(snippetTypeOrder, mediaType); i >= 0 {
+		return i
+	}
+	return len(snippetTypeOrder)
+}
+
+// srcsetAttributes returns the srcset (and sizes) attributes for a group of images of
+// the same type; sizes only makes sense when there are several widths to choose from.
+func srcsetAttributes(group []snippetImage, jsx bool) []attribute {
+	name := "srcset"
+	if jsx {
+		name = "srcSet"
+	}
+	if len(group) == 1 {
+		return []attribute{{name, snippetURL(group[0].Path)}}
+	}
+	candidates := make([]string, len(group))
+	for i, img := range group {
+		candidates[i] = fmt.Sprintf("%s %dw", snippetURL(img.Path), img.Width)
+	}
+	return []attribute{
+		{name, strings.Join(candidates, ", ")},
+		{"sizes", setting.SnippetSizes},
+	}
+}
+
+// element returns a single HTML element (or its JSX equivalent), with all values escaped.
+func element(name string, attrs []attribute, jsx bool) string {
+	var b strings.Builder
+	b.WriteString("<" + name)
+	for _, a := range attrs {
+		value := html.EscapeString(a.value)
+		if jsx {
+			// Curly braces would otherwise start a JavaScript expression.
+			value = strings.NewReplacer("{", "&#123;", "}", "&#125;").Replace(value)
+		}
+		fmt.Fprintf(&b, " %s=\"%s\"", a.name, value)
+	}
+	if jsx {
+		b.WriteString(" />")
+	} else {
+		b.WriteString(">")
+	}
+	return b.String()
+}
+
+// snippetURL returns the URL for an image written to path. With a URL prefix,
+// only the filename is kept; otherwise, the path itself is used.
+func snippetURL(path string) string {
+	if len(setting.URLPrefix) > 0 {
+		return strings.TrimSuffix(setting.URLPrefix, "/") + "/" + (&url.URL{Path: filepath.Base(path)}).EscapedPath()
+	}
+	return (&url.URL{Path: filepath.ToSlash(path)}).EscapedPath()
+}
@@ -0,0 +1,44 @@
+// Tests for HTML snippets.
+package main
+
+import "testing"
+
+// Checks the markup built for each snippet format, with the alt text, sizes and URL
+// prefix taken from the settings.
+func TestBuildSnippet(t *testing.T) {
+	saved := setting
+	defer func() { setting = saved }()
+	setting.ImageName = "photos/cat.jpg"
+	setting.SnippetAlt = "{name}"
+	setting.SnippetSizes = "100vw"
+	setting.SnippetLazy = false
+	setting.URLPrefix = "/img"
+
+	images := []snippetImage{
+		{"out/cat-640w.jpg", 640, 480, "image/jpeg"},
+		{"out/cat-320w.webp", 320, 240, "image/webp"},
+		{"out/cat-320w.jpg", 320, 240, "image/jpeg"},
+	}
+	var snippetTests = []struct {
+		format string
+		images []snippetImage
+		want   string
+	}{
+		{"img", images[:1], `<img src="/img/cat-640w.jpg" width="640" height="480" alt="cat">`},
+		{"img", images, `<img src="/img/cat-640w.jpg" srcset="/img/cat-320w.jpg 320w, /img/cat-640w.jpg 640w" sizes="100vw" width="640" height="480" alt="cat">`},
+		{"markdown", images, `![cat](/img/cat-640w.jpg)`},
+		{"picture", images[:2], "<picture>\n" +
+			`  <source type="image/webp" srcset="/img/cat-320w.webp">` + "\n" +
+			`  <img src="/img/cat-640w.jpg" width="640" height="480" alt="cat">` + "\n" +
+			"</picture>"},
+		{"jsx", images[1:2], "<picture>\n" +
+			`  <img src="/img/cat-320w.webp" width="320" height="240" alt="cat" />` + "\n" +
+			"</picture>"},
+	}
+
+	for _, tc := range snippetTests {
+		if got := buildSnippet(tc.format, tc.images); got != tc.want {
+			t.Fatalf("snippet %q for %v was:\n%s\nexpected:\n%s", tc.format, tc.images, got, tc.want)
+		}
+	}
+}
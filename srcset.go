@@ -0,0 +1,205 @@
+// Responsive image sets: every combination of widths and file types, from a
+// single upload, plus a JSON manifest for static-site generators.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+	"github.com/urfave/cli/v3"
+)
+
+// manifestEntry describes one of the files written for a responsive set.
+type manifestEntry struct {
+	Path      string `json:"path"`
+	Width     int64  `json:"width"`
+	Height    int64  `json:"height"`
+	Bytes     int64  `json:"bytes"`
+	MediaType string `json:"media_type"`
+}
+
+// srcsetManifest describes the whole responsive set.
+type srcsetManifest struct {
+	Source      string          `json:"source"`
+	Width       int64           `json:"width"`  // Width of the original.
+	Height      int64           `json:"height"` // Height of the original.
+	Variants    []manifestEntry `json:"variants"`
+	Snippet     string          `json:"snippet,omitempty"`     // Markup for all variants, if requested with --snippet.
+	Placeholder *placeholder    `json:"placeholder,omitempty"` // Only with --placeholder.
+}
+
+// srcset is the action for the `srcset` command.
+func srcset(ctx context.Context, cmd *cli.Command) error {
+	var (
+		err    error // declared here due to scope issues.
+		source *Tinify.Source
+	)
+
+	widths, err := parseWidths(cmd.String("widths"))
+	if err != nil {
+		return err
+	}
+	fileTypes := strings.Split(strings.ToLower(cmd.String("formats")), ",")
+	if err = checkFileTypes(strings.Join(fileTypes, ",")); err != nil {
+		return err
+	}
+	if err = checkSrcsetTemplate(setting.OutputTemplate, fileTypes); err != nil {
+		return err
+	}
+
+	// The output "filename" is actually a directory; the names of the variants
+	// come from the template.
+	outputDir := setting.OutputFileName
+	setting.OutputFileName = ""
+	if len(outputDir) == 0 || outputDir == "-" {
+		outputDir, _, _ = splitInputName(setting.ImageName)
+	}
+	if len(setting.OutputTemplate) == 0 {
+		setting.OutputTemplate = filepath.Join(outputDir, "{name}-{width}w.{ext}")
+	}
+	if err = os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	setting.Operation = "srcset"
+	setting.Logger.Debug().Msgf("srcset called, widths %v, formats %v", widths, fileTypes)
+
+	if ctx, source, err = openStream(ctx); errors.Is(err, errDryRun) {
+		// Just the variants which Srcset would make, as counted by writeVariants.
+		variants := len(Tinify.SrcsetWidths(widths, originalWidth())) * len(fileTypes)
+		setPlanCompressions(1 + srcsetVariantCompressions*int64(variants))
+		return nil
+	} else if isSkipped(err) {
+		return nil
+	} else if err != nil {
+		setting.Logger.Error().Msgf("srcset: invalid filenames, error was %v", err)
+		return err
+	}
+
+	variants, err := source.Srcset(widths, fileTypes)
+	if err != nil {
+		return err
+	}
+
+	manifest := srcsetManifest{
+		Source: setting.ImageName,
+		Width:  source.Shrink().Output.Width,
+		Height: source.Shrink().Output.Height,
+	}
+	if err = writeVariants(source, variants, &manifest); err != nil {
+		return err
+	}
+
+	images := make([]snippetImage, len(manifest.Variants))
+	for i, v := range manifest.Variants {
+		images[i] = snippetImage{Path: v.Path, Width: v.Width, Height: v.Height, MediaType: v.MediaType}
+	}
+	manifest.Snippet = emitSnippet(outputDir, images)
+
+	manifestPath := cmd.String("manifest")
+	if len(manifestPath) == 0 {
+		_, name, _ := splitInputName(setting.ImageName)
+		manifestPath = filepath.Join(outputDir, name+".srcset.json")
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetIndent("", "\t")
+	encoder.SetEscapeHTML(false) // keep the snippet readable.
+	if err = encoder.Encode(manifest); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(manifestPath, data.Bytes()); err != nil {
+		return err
+	}
+	setting.Logger.Info().Msgf("srcset: wrote %d variant(s) and manifest %q", len(variants), manifestPath)
+	return nil
+}
+
+// checkSrcsetTemplate makes sure that a given output template tells the variants apart:
+// by width, and also by file type if there are several of them.
+func checkSrcsetTemplate(template string, fileTypes []string) error {
+	switch {
+	case len(template) == 0:
+	case !strings.Contains(template, "{width}"):
+		return fmt.Errorf("srcset: the output template must include {width}, or all widths would get the same name")
+	case len(fileTypes) > 1 && !strings.Contains(template, "{ext}") && !strings.Contains(template, "{type}"):
+		return fmt.Errorf("srcset: with several formats, the output template must include {ext} or {type}, or all formats would get the same name")
+	}
+	return nil
+}
+
+// Compressions used by each variant of a responsive set, which is resized and converted.
+const srcsetVariantCompressions = 2
+
+// originalWidth returns the width of the image read by openStream, or zero if it cannot
+// be decoded locally (e.g. AVIF, or a URL).
+func originalWidth() int64 {
+	if originalImage == nil {
+		return 0
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(originalImage))
+	if err != nil {
+		return 0
+	}
+	return int64(config.Width)
+}
+
+// writeVariants writes each variant to the file named after the output template,
+// reporting each of them and adding them to the manifest.
+func writeVariants(source *Tinify.Source, variants []Tinify.SrcsetVariant, manifest *srcsetManifest) error {
+	err := eachOutput(len(variants), func(i int) (int64, error) {
+		v := variants[i]
+		path := expandOutputTemplate(setting.OutputTemplate, setting.ImageName, v.Result)
+		if err := writeFileAtomic(path, outputData(v.Result)); err != nil {
+			return srcsetVariantCompressions, err
+		}
+		setting.CompressionCount = v.Result.CompressionCount()
+		setting.Logger.Debug().Msgf("srcset: wrote %q (%s, %dpx)", path, v.Type, v.Width)
+
+		resultRecord(source, v.Result, path)
+		if i == 0 {
+			manifest.Placeholder = addPlaceholder(source, v.Result)
+		}
+		manifest.Variants = append(manifest.Variants, manifestEntry{
+			Path:      path,
+			Width:     v.Result.Width(),
+			Height:    v.Result.Height(),
+			Bytes:     int64(len(v.Result.Data())),
+			MediaType: v.Result.MediaType(),
+		})
+		return srcsetVariantCompressions, nil
+	})
+	if err := saveCompressionCount(setting.CompressionCount); err != nil {
+		setting.Logger.Debug().Msgf("srcset: could not save the compression count: %s", err)
+	}
+	return err
+}
+
+// parseWidths parses a comma-separated list of widths.
+func parseWidths(list string) ([]int64, error) {
+	var widths []int64
+	for item := range strings.SplitSeq(list, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		width, err := strconv.ParseInt(strings.TrimSuffix(item, "w"), 10, 64)
+		if err != nil || width < 1 {
+			return nil, fmt.Errorf("invalid width %q", item)
+		}
+		widths = append(widths, width)
+	}
+	if len(widths) == 0 {
+		return nil, fmt.Errorf("no widths given")
+	}
+	return widths, nil
+}
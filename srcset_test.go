@@ -0,0 +1,50 @@
+// Tests for responsive image sets.
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// Checks lists of widths, and the output templates accepted for responsive sets.
+func TestSrcset(t *testing.T) {
+	var widthTests = []struct {
+		list string
+		want []int64
+	}{
+		{"320,640,1280", []int64{320, 640, 1280}},
+		{" 320w, 640w ,", []int64{320, 640}},
+		{"640", []int64{640}},
+		{"", nil},
+		{",", nil},
+		{"0", nil},
+		{"-320", nil},
+		{"320px", nil},
+		{"wide", nil},
+	}
+	for _, tc := range widthTests {
+		got, err := parseWidths(tc.list)
+		if !slices.Equal(got, tc.want) || (err == nil) != (tc.want != nil) {
+			t.Fatalf("%q: got %v (error %v), expected %v", tc.list, got, err, tc.want)
+		}
+	}
+
+	var templateTests = []struct {
+		template string
+		types    []string
+		valid    bool
+	}{
+		{"", []string{"webp", "avif"}, true},
+		{"{name}-{width}w.{ext}", []string{"webp", "avif"}, true},
+		{"{name}-{width}w-{type}.img", []string{"webp", "avif"}, true},
+		{"{name}-{width}w.webp", []string{"webp"}, true},
+		{"{name}.{ext}", []string{"webp"}, false},
+		{"{name}-{hash8}.{ext}", []string{"webp", "avif"}, false},
+		{"{name}-{width}w.img", []string{"webp", "avif"}, false},
+	}
+	for _, tc := range templateTests {
+		if err := checkSrcsetTemplate(tc.template, tc.types); (err == nil) != tc.valid {
+			t.Fatalf("%q with %v: got error %v, expected valid to be %t", tc.template, tc.types, err, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// End-of-run summary: how much was saved across all images, which ones did best
+// and worst, and how many compressions it took.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Valid values for --summary.
+var summaryFormats = []string{"text", "json", "csv", "none"}
+
+// summary adds up all records of a run.
+type summary struct {
+	Images           int     `json:"images"` // Successfully processed.
+	Skipped          int     `json:"skipped"`
+	Failed           int     `json:"failed"`
+	BytesBefore      int64   `json:"bytes_before"`
+	BytesAfter       int64   `json:"bytes_after"`
+	BytesSaved       int64   `json:"bytes_saved"`
+	Savings          float64 `json:"savings_percent"`
+	Duration         float64 `json:"duration_seconds"`
+	Compressions     int64   `json:"compressions"`      // Used by this run.
+	CompressionCount int64   `json:"compression_count"` // Latest one returned by the API.
+	Best             *record `json:"best,omitempty"`
+	Worst            *record `json:"worst,omitempty"`
+}
+
+// All finished records, whatever the output format, for the summary.
+var summaryRecords []record
+
+// summarise adds up the records.
+func summarise(recs []record) summary {
+	var s summary
+	for i, rec := range recs {
+		switch {
+		case len(rec.Error) > 0:
+			s.Failed++
+			continue
+		case len(rec.Skipped) > 0:
+			// Some are only skipped after calling the API, e.g. for insufficient gain.
+			s.Skipped++
+			s.Compressions += rec.Compressions
+			continue
+		}
+		s.Images++
+		s.BytesBefore += rec.BytesBefore
+		s.BytesAfter += rec.BytesAfter
+		s.Duration += rec.Duration
+		s.Compressions += rec.Compressions
+		s.CompressionCount = max(s.CompressionCount, rec.CompressionCount)
+		if rec.BytesBefore == 0 {
+			continue
+		}
+		if s.Best == nil || betterSavings(&rec, s.Best) {
+			s.Best = &recs[i]
+		}
+		// On a tie, the last one, so that it's not the same as the best.
+		if s.Worst == nil || !betterSavings(&rec, s.Worst) {
+			s.Worst = &recs[i]
+		}
+	}
+	s.BytesSaved = s.BytesBefore - s.BytesAfter
+	if s.BytesBefore > 0 {
+		s.Savings = float64(s.BytesSaved) * 100 / float64(s.BytesBefore)
+	}
+	// With a single image, it's both, which says nothing.
+	if s.Images < 2 {
+		s.Best, s.Worst = nil, nil
+	}
+	return s
+}
+
+// betterSavings compares records by the percentage saved, and then by the bytes saved.
+func betterSavings(a, b *record) bool {
+	if a.Savings != b.Savings {
+		return a.Savings > b.Savings
+	}
+	return a.BytesBefore-a.BytesAfter > b.BytesBefore-b.BytesAfter
+}
+
+// printSummary writes the summary of the run so far, in the format given by --summary,
+// to --summary-file, or STDERR (which is never where images or reports go). Runs where
+// nothing was done, e.g. dry runs, have no summary.
+func printSummary() error {
+	defer func() { summaryRecords = nil }()
+	if len(summaryRecords) == 0 || setting.SummaryFormat == "none" {
+		return nil
+	}
+
+	var w io.Writer = os.Stderr
+	if len(setting.SummaryFile) > 0 && setting.SummaryFile != "-" {
+		f, err := os.Create(setting.SummaryFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	s := summarise(summaryRecords)
+	switch setting.SummaryFormat {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "\t")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(s)
+	case "csv":
+		return writeSummaryCSV(w, summaryRecords, s)
+	}
+
+	fmt.Fprintf(w, "SUMMARY: %d image(s) processed, %d skipped, %d failed\n", s.Images, s.Skipped, s.Failed)
+	if s.Images == 0 {
+		if s.Compressions > 0 {
+			fmt.Fprintf(w, "  Compressions:  %d\n", s.Compressions)
+		}
+		return nil
+	}
+	fmt.Fprintf(w, "  Before:        %s\n", formatBytes(s.BytesBefore))
+	fmt.Fprintf(w, "  After:         %s\n", formatBytes(s.BytesAfter))
+	fmt.Fprintf(w, "  Saved:         %s (%.1f%%)\n", formatBytes(s.BytesSaved), s.Savings)
+	fmt.Fprintf(w, "  Time:          %.2fs\n", s.Duration)
+	fmt.Fprintf(w, "  Compressions:  %d (compression count is now %d)\n", s.Compressions, s.CompressionCount)
+	if s.Best != nil {
+		fmt.Fprintf(w, "  Best:          %s (%s, %.1f%% saved)\n", summaryName(s.Best), formatBytes(s.Best.BytesBefore-s.Best.BytesAfter), s.Best.Savings)
+		fmt.Fprintf(w, "  Worst:         %s (%s, %.1f%% saved)\n", summaryName(s.Worst), formatBytes(s.Worst.BytesBefore-s.Worst.BytesAfter), s.Worst.Savings)
+	}
+	return nil
+}
+
+// summaryName returns the output of a record, which tells apart several outputs of the
+// same input (e.g. with `srcset`), or the input, if the output went to STDOUT.
+func summaryName(rec *record) string {
+	if rec.Output == "-" || len(rec.Output) == 0 {
+		return rec.Input
+	}
+	return rec.Output
+}
+
+// writeSummaryCSV writes one row per image, followed by a row with the totals.
+func writeSummaryCSV(w io.Writer, recs []record, s summary) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"input", "output", "status", "bytes_before", "bytes_after", "bytes_saved", "savings_percent", "duration_seconds", "compressions"})
+	for _, rec := range recs {
+		status := "processed"
+		switch {
+		case len(rec.Error) > 0:
+			status = "failed: " + rec.Error
+		case len(rec.Skipped) > 0:
+			status = "skipped: " + rec.Skipped
+		}
+		cw.Write([]string{
+			rec.Input,
+			rec.Output,
+			status,
+			strconv.FormatInt(rec.BytesBefore, 10),
+			strconv.FormatInt(rec.BytesAfter, 10),
+			strconv.FormatInt(rec.BytesBefore-rec.BytesAfter, 10),
+			strconv.FormatFloat(rec.Savings, 'f', 1, 64),
+			strconv.FormatFloat(rec.Duration, 'f', 2, 64),
+			strconv.FormatInt(rec.Compressions, 10),
+		})
+	}
+	cw.Write([]string{
+		"total",
+		"",
+		fmt.Sprintf("%d processed, %d skipped, %d failed", s.Images, s.Skipped, s.Failed),
+		strconv.FormatInt(s.BytesBefore, 10),
+		strconv.FormatInt(s.BytesAfter, 10),
+		strconv.FormatInt(s.BytesSaved, 10),
+		strconv.FormatFloat(s.Savings, 'f', 1, 64),
+		strconv.FormatFloat(s.Duration, 'f', 2, 64),
+		strconv.FormatInt(s.Compressions, 10),
+	})
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatBytes returns a size in bytes in a human-readable way, e.g. "4.2 MB".
+func formatBytes(n int64) string {
+	const unit = 1000
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	if n < unit {
+		return fmt.Sprintf("%s%d B", sign, n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%s%.1f %cB", sign, float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,43 @@
+// Tests for the summary printed at the end of a run.
+package main
+
+import "testing"
+
+// Checks the totals, best and worst images of the summary, and the formatting of sizes.
+func TestSummarise(t *testing.T) {
+	recs := []record{
+		{Input: "a.png", BytesBefore: 1000, BytesAfter: 500, Savings: 50, Compressions: 1, CompressionCount: 10},
+		{Input: "b.png", BytesBefore: 4000, BytesAfter: 2000, Savings: 50, Compressions: 2, CompressionCount: 12},
+		{Input: "c.jpg", BytesBefore: 1000, BytesAfter: 900, Savings: 10, Compressions: 1, CompressionCount: 13},
+		{Input: "d.jpg", Skipped: "already processed"},
+		{Input: "e.jpg", Error: "boom"},
+	}
+	s := summarise(recs)
+	if s.Images != 3 || s.Skipped != 1 || s.Failed != 1 {
+		t.Fatalf("counted %d processed, %d skipped, %d failed, expected 3, 1, 1", s.Images, s.Skipped, s.Failed)
+	}
+	if s.BytesSaved != 2600 || s.Compressions != 4 || s.CompressionCount != 13 {
+		t.Fatalf("got %d byte(s) saved, %d compression(s), count %d, expected 2600, 4, 13", s.BytesSaved, s.Compressions, s.CompressionCount)
+	}
+	if s.Best == nil || s.Best.Input != "b.png" || s.Worst == nil || s.Worst.Input != "c.jpg" {
+		t.Fatalf("got best %v and worst %v, expected b.png and c.jpg", s.Best, s.Worst)
+	}
+
+	if s = summarise(recs[:1]); s.Best != nil || s.Worst != nil {
+		t.Fatalf("a single image should have no best or worst")
+	}
+
+	var sizeTests = []struct {
+		n    int64
+		want string
+	}{
+		{999, "999 B"},
+		{4200000, "4.2 MB"},
+		{-1500, "-1.5 kB"},
+	}
+	for _, tc := range sizeTests {
+		if got := formatBytes(tc.n); got != tc.want {
+			t.Fatalf("formatted %d and got %q, expected %q", tc.n, got, tc.want)
+		}
+	}
+}
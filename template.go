@@ -0,0 +1,160 @@
+// Output filename templates, used to give predictable names to the images
+// written by the CLI, especially when processing many files in a row.
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+)
+
+// Placeholders recognised by --output-template, and what they stand for.
+var templatePlaceholders = map[string]string{
+	"{dir}":    "directory of the input file",
+	"{name}":   "input filename, without extension",
+	"{ext}":    "extension matching the Media Type returned by the API",
+	"{width}":  "width of the resulting image",
+	"{height}": "height of the resulting image",
+	"{method}": "resizing method",
+	"{preset}": "name of the resize preset, with --preset",
+	"{type}":   "file type returned by the API (png, jpeg, webp, avif)",
+	"{hash8}":  "first 8 hex digits of the SHA-256 hash of the resulting image",
+}
+
+// expandOutputTemplate replaces all placeholders in tmpl with the values
+// taken from the input path, the global settings, and the result's headers.
+// If result is nil, the placeholders which depend on it are left untouched;
+// this allows checking the output directory *before* calling the API.
+func expandOutputTemplate(tmpl string, input string, result *Tinify.Result) string {
+	dir, name, ext := splitInputName(input)
+
+	pairs := []string{
+		"{dir}", dir,
+		"{name}", name,
+		"{method}", setting.Method,
+		"{preset}", setting.Preset,
+	}
+
+	if result != nil {
+		width, height := result.Width(), result.Height()
+		// Some responses may not include the dimensions; use whatever was requested instead.
+		if width == 0 {
+			width = setting.Width
+		}
+		if height == 0 {
+			height = setting.Height
+		}
+		fileType := typeFromMediaType(result.MediaType())
+		if resultExt := extensionFromMediaType(result.MediaType()); resultExt != "" {
+			ext = resultExt
+		}
+
+		pairs = append(pairs,
+			"{ext}", ext,
+			"{width}", strconv.FormatInt(width, 10),
+			"{height}", strconv.FormatInt(height, 10),
+			"{type}", fileType,
+			"{hash8}", hashBytes(result.Data())[:8],
+		)
+	}
+
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
+
+// splitInputName extracts the directory, base name (without extension) and extension
+// (without the dot) from the input, which may be a filename, an URL, or empty (STDIN).
+func splitInputName(input string) (dir, name, ext string) {
+	dir = "."
+	if len(input) == 0 || input == "-" {
+		return dir, "stdin", ""
+	}
+	if strings.Contains(input, "://") {
+		// For URLs, only the last path component is meaningful to us.
+		if u, err := url.Parse(input); err == nil {
+			input = u.Path
+		}
+	} else {
+		dir = filepath.Dir(input)
+	}
+	base := filepath.Base(input)
+	ext = filepath.Ext(base)
+	name = strings.TrimSuffix(base, ext)
+	if len(name) == 0 || name == "/" || name == "." {
+		name = "image"
+	}
+	return dir, name, strings.TrimPrefix(ext, ".")
+}
+
+// typeFromMediaType returns the Tinify file type (e.g. "webp") for a given Media Type,
+// or an empty string if it's not one of the supported types.
+func typeFromMediaType(mediaType string) string {
+	// Media Types may come with parameters, which we don't care about.
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	for fileType, mime := range Tinify.ConvertMIMETypes {
+		if mime == strings.TrimSpace(mediaType) {
+			return fileType
+		}
+	}
+	return ""
+}
+
+// extensionFromMediaType returns the usual filename extension (without the dot)
+// for a given Media Type, or an empty string if it's not one of the supported types.
+func extensionFromMediaType(mediaType string) string {
+	fileType := typeFromMediaType(mediaType)
+	if fileType == "jpeg" {
+		return "jpg"
+	}
+	return fileType
+}
+
+// typeFromExtension returns the Tinify file type (e.g. "jpeg") for a filename extension,
+// with or without the dot, or an empty string if it's not one of the supported types.
+func typeFromExtension(ext string) string {
+	switch strings.ToLower(strings.TrimPrefix(ext, ".")) {
+	case "jpg", "jpeg", "jpe":
+		return "jpeg"
+	case "png":
+		return "png"
+	case "webp":
+		return "webp"
+	case "avif":
+		return "avif"
+	}
+	return ""
+}
+
+// inferConvertType figures out which file type to convert to, when none was given,
+// from the extension of the output filename (or template). Only when writing to STDOUT,
+// or to a template whose extension is a placeholder, is there no way to tell, and WebP
+// is used instead.
+func inferConvertType(output, tmpl string) (string, error) {
+	switch {
+	case len(output) > 0 && output != "-":
+		fileType := typeFromExtension(filepath.Ext(output))
+		if len(fileType) == 0 {
+			return "", fmt.Errorf("convert: cannot tell the file type from the extension of %q; please use --type", output)
+		}
+		return fileType, nil
+	case len(output) == 0 && len(tmpl) > 0:
+		if fileType := typeFromExtension(filepath.Ext(tmpl)); len(fileType) > 0 {
+			return fileType, nil
+		}
+	}
+	return "webp", nil
+}
+
+// matchExtension returns the output filename with its extension changed to match the
+// Media Type actually returned by the API, if they differ (e.g. with several types).
+func matchExtension(output, mediaType string) string {
+	ext := extensionFromMediaType(mediaType)
+	current := filepath.Ext(output)
+	if len(ext) == 0 || typeFromExtension(current) == typeFromMediaType(mediaType) {
+		return output
+	}
+	return strings.TrimSuffix(output, current) + "." + ext
+}
@@ -0,0 +1,104 @@
+// Tests for output templates, and for the types inferred from output filenames.
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	Tinify "github.com/gwpp/tinify-go/tinify"
+)
+
+// Checks that output templates are correctly filled in, both before and after
+// getting a result from the API.
+func TestExpandOutputTemplate(t *testing.T) {
+	saved := setting
+	defer func() { setting = saved }()
+	header := http.Header{}
+	header.Set("Content-Type", "image/webp")
+	header.Set("Image-Width", "800")
+	header.Set("Image-Height", "600")
+	result := Tinify.NewResult(header, []byte("not really an image"))
+
+	setting.Method = Tinify.ResizeMethodFit
+
+	var templateTests = []struct {
+		tmpl     string
+		input    string
+		result   *Tinify.Result
+		expected string
+	}{
+		{"{name}-{width}w.{ext}", "photos/cat.png", result, "cat-800w.webp"},
+		{"{dir}/{name}.{ext}", "photos/cat.png", result, "photos/cat.webp"},
+		{"{dir}/{name}-{method}-{width}x{height}.{type}", "photos/cat.png", result, "photos/cat-fit-800x600.webp"},
+		{"{name}.{hash8}.{ext}", "cat.png", result, "cat.109bc410.webp"},
+		{"{dir}/{name}-{width}w.{ext}", "photos/cat.png", nil, "photos/cat-{width}w.{ext}"},
+		{"{name}.{ext}", "", result, "stdin.webp"},
+		{"{dir}/{name}.{ext}", "https://example.com/img/dog.jpg?x=1", result, "./dog.webp"},
+	}
+
+	for _, tc := range templateTests {
+		if got := expandOutputTemplate(tc.tmpl, tc.input, tc.result); got != tc.expected {
+			t.Fatalf("expanded %q for input %q and got %q, expected %q", tc.tmpl, tc.input, got, tc.expected)
+		}
+	}
+}
+
+// Checks the file types inferred for `convert` from output filenames and templates, and
+// the extensions of outputs renamed to match the type returned by the API.
+func TestConvertTypeInference(t *testing.T) {
+	var extensionTests = []struct {
+		ext, want string
+	}{
+		{".jpg", "jpeg"},
+		{"JPEG", "jpeg"},
+		{".png", "png"},
+		{".webp", "webp"},
+		{"avif", "avif"},
+		{".gif", ""},
+		{"", ""},
+	}
+	for _, tc := range extensionTests {
+		if got := typeFromExtension(tc.ext); got != tc.want {
+			t.Fatalf("type for extension %q is %q, expected %q", tc.ext, got, tc.want)
+		}
+	}
+
+	var inferTests = []struct {
+		output, tmpl string
+		want         string // Empty if an error is expected.
+	}{
+		{"photo.jpg", "", "jpeg"},
+		{"out/photo.JPEG", "", "jpeg"},
+		{"photo.png", "", "png"},
+		{"photo.avif", "", "avif"},
+		{"photo.webp", "", "webp"},
+		{"photo.img", "", ""},
+		{"photo", "", ""},
+		{"", "", "webp"},
+		{"-", "", "webp"},
+		{"", "{dir}/{name}.avif", "avif"},
+		{"", "{dir}/{name}.{ext}", "webp"},
+	}
+	for _, tc := range inferTests {
+		got, err := inferConvertType(tc.output, tc.tmpl)
+		if (err != nil) != (len(tc.want) == 0) || got != tc.want {
+			t.Fatalf("inferred %q from %q (template %q), with error %v; expected %q", got, tc.output, tc.tmpl, err, tc.want)
+		}
+	}
+
+	var renameTests = []struct {
+		output, mediaType, want string
+	}{
+		{"photo.webp", "image/webp", "photo.webp"},
+		{"photo.webp", "image/avif", "photo.avif"},
+		{"photo.jpeg", "image/jpeg", "photo.jpeg"},
+		{"photo.png", "image/jpeg", "photo.jpg"},
+		{"photo", "image/png", "photo.png"},
+		{"photo.webp", "application/json", "photo.webp"},
+	}
+	for _, tc := range renameTests {
+		if got := matchExtension(tc.output, tc.mediaType); got != tc.want {
+			t.Fatalf("renamed %q for %s and got %q, expected %q", tc.output, tc.mediaType, got, tc.want)
+		}
+	}
+}
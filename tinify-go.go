@@ -6,15 +6,22 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	//	"io/fs"
+	"maps"
 	"net/http"
 	"net/mail"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/GwynethLlewelyn/justify"
@@ -33,6 +40,7 @@ type Setting struct {
 	LoggingLevel     string         `json:"log_level"`         // Debug/verbosity level, "error" by default
 	ImageName        string         `json:"image_name"`        // Filename or URL.
 	OutputFileName   string         `json:"output_file_name"`  // If set, it's the output filename; if not, well...
+	OutputTemplate   string         `json:"output_template"`   // Template for the output filename, e.g. "{name}-{width}w.{ext}".
 	FileType         string         `json:"file_type"`         // Any set of webp, png, jpg, avif.
 	Key              string         `json:"key"`               // TinyPNG API key; can be on environment or read from `.env`.
 	Logger           zerolog.Logger `json:"-"`                 // The main setting.Logger.
@@ -42,6 +50,48 @@ type Setting struct {
 	Transform        string         `json:"transform"`         // Transform the background to one of 'black', 'white', or hex value.
 	TerminalWidth    int            `json:"terminal_width"`    // If we're on a TTY, stores the width; 80 is default.
 	CompressionCount int64          `json:"compression_count"` // A measure of how many crdits are still left for further compression.
+	LastOutput       string         `json:"-"`                 // Filename actually written by the last API call (empty for STDOUT).
+	Operation        string         `json:"operation"`         // Operation being applied (compress, resize, convert, transform); selectable in watch mode.
+	WatchDir         string         `json:"watch_dir"`         // Directory tree being watched for new or changed images.
+	MirrorDir        string         `json:"mirror_dir"`        // If set, watch mode writes its outputs to this mirror tree.
+	InPlace          bool           `json:"in_place"`          // If set, watch mode overwrites the original images.
+	Debounce         time.Duration  `json:"debounce"`          // How long to wait for writes to settle before processing a file.
+	Listen           string         `json:"listen"`            // Address for the HTTP server to listen on.
+	DryRun           bool           `json:"dry_run"`           // If set, do all the local checks, but upload nothing and print a plan instead.
+	PlanFormat       string         `json:"plan_format"`       // Format for the dry-run plan (text or json).
+	OutputFormat     string         `json:"output_format"`     // Format for the per-image reports (text, json, ndjson); empty for none.
+	SummaryFormat    string         `json:"summary_format"`    // Format for the end-of-run summary (text, json, csv, none).
+	SummaryFile      string         `json:"summary_file"`      // Where the summary is written to; STDERR if empty.
+	Profile          string         `json:"profile"`           // Named profile selected from the configuration files.
+	Proxy            string         `json:"proxy"`             // HTTP(S) proxy used just for the Tinify API.
+	Concurrency      int            `json:"concurrency"`       // Maximum number of simultaneous API calls.
+	Snippet          string         `json:"snippet"`           // Format of the markup snippet for each image (picture, img, markdown, jsx); empty for none.
+	SnippetSizes     string         `json:"snippet_sizes"`     // Value of the `sizes` attribute on snippets.
+	SnippetAlt       string         `json:"snippet_alt"`       // Alternative text on snippets; may include {name} and {dir}.
+	SnippetLazy      bool           `json:"snippet_lazy"`      // If set, snippets use lazy loading.
+	URLPrefix        string         `json:"url_prefix"`        // Prefix for the image URLs on snippets.
+	SiteDir          string         `json:"site_dir"`          // Root of the site whose image references get rewritten.
+	RemoteDir        string         `json:"remote_dir"`        // Where remote images are saved to, when rewriting references.
+	IncludeRemote    bool           `json:"include_remote"`    // If set, remote images are also processed when rewriting references.
+	HashNames        bool           `json:"hash_names"`        // If set, rewritten references use content-hashed filenames.
+	Ledger           string         `json:"ledger"`            // Path to the ledger of processed images.
+	Force            bool           `json:"force"`             // If set, images are processed even if the ledger or their marker say they need not be.
+	Mark             bool           `json:"mark"`              // If set, a marker is embedded on each output, so that it's never processed again.
+	GitStaged        bool           `json:"git_staged"`        // If set, the git command processes the staged images (the default).
+	GitSince         string         `json:"git_since"`         // If set, the git command processes the images changed since this revision.
+	VerifyKey        bool           `json:"verify_key"`        // If set, the API key is validated before doing any work.
+	MinSavings       float64        `json:"min_savings"`       // Minimum savings, in percent, for a result to be kept instead of the original.
+	MinSavingsBytes  int64          `json:"min_savings_bytes"` // Minimum savings, in bytes, for a result to be kept instead of the original.
+	MinSSIM          float64        `json:"min_ssim"`          // Minimum SSIM between the original and the result; zero for no quality check.
+	LowQuality       string         `json:"low_quality"`       // What to do with results below the minimum SSIM (reject, warn).
+	EachType         bool           `json:"each_type"`         // If set, convert writes one output per requested file type.
+	RenameOutput     bool           `json:"rename_output"`     // If set, the output extension is changed to match the type returned by the API.
+	JPEGBackground   string         `json:"jpeg_background"`   // Background for images with transparency converted to JPEG, unless --background is given.
+	PageColour       string         `json:"page_colour"`       // Background used by --background auto when the edges of the image are transparent.
+	Placeholder      string         `json:"placeholder"`       // How placeholders are made for each image (none, local, api).
+	PlaceholderSize  int64          `json:"placeholder_size"`  // Longest side of placeholders, in pixels.
+	Presets          string         `json:"presets"`           // Resize presets to use, comma-separated.
+	Preset           string         `json:"preset"`            // Resize preset being used right now, if any.
 }
 
 // Global settings for this CLI app.
@@ -56,6 +106,23 @@ var types = []string{
 	"avif",
 }
 
+// Operations that can be applied to an image, one per API call.
+var operations = []string{
+	"compress",
+	"resize",
+	"convert",
+	"transform",
+}
+
+// Commands which do not need an API key, since they never call the API;
+// subcommands are given together with their parent.
+var offlineCommands = []string{
+	"compare",
+	"config",
+	"git install-hook",
+	"presets",
+}
+
 // Available image resizing methods.
 // Add more when TinyPNG supports additional types.
 var methods = []string{
@@ -166,7 +233,106 @@ func main() {
 		},
 	}
 
-	// these are flags
+	// These are flags shared by several commands.
+	var (
+		operationFlag = &cli.StringFlag{
+			Name:        "operation",
+			Aliases:     []string{"op"},
+			Value:       "compress",
+			Usage:       "`operation` to apply to each image [" + strings.Join(operations, ", ") + "]",
+			Destination: &setting.Operation,
+			Action: func(ctx context.Context, c *cli.Command, s string) error {
+				if !slices.Contains(operations, setting.Operation) {
+					return fmt.Errorf("invalid operation: %q", setting.Operation)
+				}
+				return nil
+			},
+		}
+		methodFlag = &cli.StringFlag{
+			Name:        "method",
+			Sources:     configSources("method"),
+			Aliases:     []string{"m"},
+			Value:       Tinify.ResizeMethodScale,
+			Usage:       "resizing method [" + strings.Join(methods, ", ") + "]",
+			Destination: &setting.Method,
+			Action: func(ctx context.Context, c *cli.Command, s string) error {
+				// Check if the resizing method is a valid one.
+				// First check if it's empty:
+				if len(setting.Method) == 0 {
+					setting.Method = Tinify.ResizeMethodScale // scale is default
+				} else if !slices.Contains(methods, setting.Method) {
+					// Checked if it's one of the valid methods; if not, abort.
+					return fmt.Errorf("invalid resize method: %q", setting.Method)
+				}
+				return nil
+			},
+		}
+		widthFlag = &cli.Int64Flag{
+			Name:        "width",
+			Sources:     configSources("width"),
+			Aliases:     []string{"w"},
+			Value:       0,
+			Usage:       "destination image `width`",
+			Destination: &setting.Width,
+			Action: func(ctx context.Context, c *cli.Command, i int64) error {
+				if i < 1 {
+					return fmt.Errorf("width must be at least 1, %d provided", i)
+				}
+				return nil
+			},
+		}
+		heightFlag = &cli.Int64Flag{
+			Name:        "height",
+			Sources:     configSources("height"),
+			Aliases:     []string{"g"},
+			Value:       0,
+			Usage:       "destination image `height`",
+			Destination: &setting.Height,
+			Action: func(ctx context.Context, c *cli.Command, i int64) error {
+				if i < 1 {
+					return fmt.Errorf("height must be at least 1, %d provided", i)
+				}
+				return nil
+			},
+		}
+		typeFlag = &cli.StringFlag{
+			Name:        "type",
+			Sources:     configSources("type"),
+			Aliases:     []string{"t"},
+			Usage:       "file type [" + strings.Join(types, ", ") + "]",
+			Value:       "webp",
+			Destination: &setting.FileType,
+			Action: func(ctx context.Context, c *cli.Command, s string) error {
+				// Check if the type(s) are all valid:
+				if setting.FileType != "" {
+					if err := checkFileTypes(setting.FileType); err != nil {
+						return err
+					}
+					// if we're here, all file types are valid
+					setting.Logger.Debug().Msg("convert: all file type parameters are valid")
+				} else {
+					setting.Logger.Debug().Msg("convert: no file type parameters found, trying to guess")
+				}
+				return nil
+			},
+		}
+		backgroundFlag = &cli.StringFlag{
+			Name:        "background",
+			Sources:     configSources("background"),
+			Aliases:     []string{"bg"},
+			Value:       "",
+			Usage:       "only \"white\", \"black\", a hex `value`, or \"auto\" (picked from the edges of the image) are allowed",
+			Destination: &setting.Transform,
+			Action: func(ctx context.Context, c *cli.Command, s string) error {
+				// Check if value passed is correct.
+				setting.Transform = strings.ToLower(setting.Transform)
+				if setting.Transform != autoBackground && !isValidBackground(setting.Transform) {
+					return fmt.Errorf("background colour: invalid hex value %q", setting.Transform)
+				}
+				return nil
+			},
+		}
+	)
 
 	// start CLI app
 	cmd := &cli.Command{
@@ -190,6 +356,38 @@ func main() {
 		Copyright: justify.Justify(fmt.Sprintf("© 2017-%d by Ganwen Peng. All rights reserved. Freely distributed under an MIT license.\nThe authors are neither affiliated nor endorsed by Tinify B.V.", time.Now().Year()), setting.TerminalWidth),
 		Arguments: inputOutputFilenames,
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "profile",
+				Aliases:     []string{"p"},
+				Usage:       "use the named `profile` from the configuration files",
+				Sources:     profileSources(os.Args[1:]),
+				Destination: &setting.Profile,
+			},
+			&cli.StringFlag{
+				Name:        "key",
+				Usage:       "TinyPNG API `key`",
+				Sources:     configSources("key", "TINIFY_API_KEY"),
+				Destination: &setting.Key,
+			},
+			&cli.StringFlag{
+				Name:        "proxy",
+				Usage:       "HTTP(S) proxy `URL` used just for the Tinify API",
+				Sources:     configSources("proxy"),
+				Destination: &setting.Proxy,
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Value:       4,
+				Usage:       "maximum `number` of simultaneous API calls",
+				Sources:     configSources("concurrency"),
+				Destination: &setting.Concurrency,
+				Action: func(ctx context.Context, c *cli.Command, i int) error {
+					if i < 1 {
+						return fmt.Errorf("concurrency must be at least 1, %d provided", i)
+					}
+					return nil
+				},
+			},
 			&cli.StringFlag{
 				Name:        "input",
 				Aliases:     []string{"i"},
@@ -202,6 +400,219 @@ func main() {
 				Usage:       "output `filename` (empty or '-' for STDOUT)",
 				Destination: &setting.OutputFileName,
 			},
+			&cli.StringFlag{
+				Name:        "output-template",
+				Sources:     configSources("output-template"),
+				Usage:       "`template` for the output filename when none is given, e.g. \"{name}-{width}w.{ext}\"; placeholders: " + strings.Join(slices.Sorted(maps.Keys(templatePlaceholders)), ", "),
+				Destination: &setting.OutputTemplate,
+			},
+			&cli.StringFlag{
+				Name:        "ledger",
+				Usage:       "keep a ledger of processed images on this `file`, and skip those which did not change since",
+				Sources:     configSources("ledger"),
+				Destination: &setting.Ledger,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Usage:       "process images even if they were processed before, overwriting edited outputs",
+				Destination: &setting.Force,
+			},
+			&cli.BoolFlag{
+				Name:        "mark",
+				Usage:       "embed a marker on each output, so that it is skipped if it ever comes back for processing",
+				Sources:     configSources("mark"),
+				Destination: &setting.Mark,
+			},
+			&cli.StringFlag{
+				Name:    "min-savings",
+				Usage:   "keep the original unless the result is at least this `percentage` smaller, e.g. 5%",
+				Sources: configSources("min-savings"),
+				Action: func(ctx context.Context, c *cli.Command, s string) (err error) {
+					setting.MinSavings, err = parseMinSavings(s)
+					return err
+				},
+			},
+			&cli.Int64Flag{
+				Name:        "min-savings-bytes",
+				Usage:       "keep the original unless the result is at least this many `bytes` smaller",
+				Sources:     configSources("min-savings-bytes"),
+				Destination: &setting.MinSavingsBytes,
+			},
+			&cli.StringFlag{
+				Name:        "jpeg-background",
+				Value:       "white",
+				Usage:       "fill transparent pixels with this `colour` when converting to JPEG, unless --background is given (\"white\", \"black\", or a hex value)",
+				Sources:     configSources("jpeg-background"),
+				Destination: &setting.JPEGBackground,
+				Action: func(ctx context.Context, c *cli.Command, s string) error {
+					setting.JPEGBackground = strings.ToLower(s)
+					if !isValidBackground(setting.JPEGBackground) {
+						return fmt.Errorf("jpeg background colour: invalid hex value %q", s)
+					}
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:        "page-colour",
+				Value:       "white",
+				Usage:       "`colour` of the page where images are shown, used by --background auto when their edges are transparent (\"white\", \"black\", or a hex value)",
+				Sources:     configSources("page-colour"),
+				Destination: &setting.PageColour,
+				Action: func(ctx context.Context, c *cli.Command, s string) error {
+					setting.PageColour = strings.ToLower(s)
+					if !isValidBackground(setting.PageColour) {
+						return fmt.Errorf("page colour: invalid hex value %q", s)
+					}
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:        "placeholder",
+				Value:       "none",
+				Usage:       "add a tiny placeholder of each image (as a data URI), its BlurHash and dominant colour to the JSON output and manifests, scaled down by this `method` [" + strings.Join(placeholderModes, ", ") + "]; api costs one additional compression",
+				Sources:     configSources("placeholder"),
+				Destination: &setting.Placeholder,
+				Action: func(ctx context.Context, c *cli.Command, s string) error {
+					setting.Placeholder = strings.ToLower(s)
+					if !slices.Contains(placeholderModes, setting.Placeholder) {
+						return fmt.Errorf("invalid placeholder method: %q", s)
+					}
+					return nil
+				},
+			},
+			&cli.Int64Flag{
+				Name:        "placeholder-size",
+				Value:       16,
+				Usage:       "longest side of placeholders, in `pixels`",
+				Sources:     configSources("placeholder-size"),
+				Destination: &setting.PlaceholderSize,
+				Action: func(ctx context.Context, c *cli.Command, i int64) error {
+					if i < 1 || i > 256 {
+						return fmt.Errorf("placeholder size must be between 1 and 256 pixels, got %d", i)
+					}
+					return nil
+				},
+			},
+			&cli.FloatFlag{
+				Name:        "min-ssim",
+				Usage:       "compare each result with the original, and reject it if their SSIM is below this `value`, e.g. 0.95",
+				Sources:     configSources("min-ssim"),
+				Destination: &setting.MinSSIM,
+				Action: func(ctx context.Context, c *cli.Command, f float64) error {
+					if f < 0 || f > 1 {
+						return fmt.Errorf("invalid minimum SSIM %v; expected a value between 0 and 1", f)
+					}
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:        "low-quality",
+				Value:       "reject",
+				Usage:       "what to do with results below --min-ssim: keep the original (reject), or just flag them (warn)",
+				Sources:     configSources("low-quality"),
+				Destination: &setting.LowQuality,
+				Action: func(ctx context.Context, c *cli.Command, s string) error {
+					if !slices.Contains(lowQualityActions, s) {
+						return fmt.Errorf("invalid action for low quality results: %q", s)
+					}
+					return nil
+				},
+			},
+			&cli.BoolFlag{
+				Name:        "verify-key",
+				Usage:       "check that the API key is valid before doing any work",
+				Sources:     configSources("verify-key"),
+				Destination: &setting.VerifyKey,
+			},
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Aliases:     []string{"n"},
+				Usage:       "do all the local checks and print a plan with the estimated cost, but upload nothing",
+				Destination: &setting.DryRun,
+			},
+			&cli.StringFlag{
+				Name:        "output-format",
+				Aliases:     []string{"f"},
+				Usage:       "report each processed image in this `format` [" + strings.Join(outputFormats, ", ") + "]",
+				Destination: &setting.OutputFormat,
+				Action: func(ctx context.Context, c *cli.Command, s string) error {
+					if !slices.Contains(outputFormats, s) {
+						return fmt.Errorf("invalid output format: %q", s)
+					}
+					// Unless explicitly set, the dry-run plan follows suit.
+					if s != "text" && !c.IsSet("plan-format") {
+						setting.PlanFormat = "json"
+					}
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:        "summary",
+				Value:       "text",
+				Usage:       "`format` of the summary printed at the end of each run [" + strings.Join(summaryFormats, ", ") + "]",
+				Sources:     configSources("summary"),
+				Destination: &setting.SummaryFormat,
+				Action: func(ctx context.Context, c *cli.Command, s string) error {
+					if !slices.Contains(summaryFormats, s) {
+						return fmt.Errorf("invalid summary format: %q", s)
+					}
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:        "summary-file",
+				Usage:       "write the summary to `file`, instead of STDERR",
+				Destination: &setting.SummaryFile,
+			},
+			&cli.StringFlag{
+				Name:        "plan-format",
+				Value:       "text",
+				Usage:       "`format` of the dry-run plan [text, json]",
+				Destination: &setting.PlanFormat,
+				Action: func(ctx context.Context, c *cli.Command, s string) error {
+					if s != "text" && s != "json" {
+						return fmt.Errorf("invalid plan format: %q", s)
+					}
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:        "snippet",
+				Usage:       "print ready-to-paste markup for each image, in this `format` [" + strings.Join(snippetFormats, ", ") + "]",
+				Destination: &setting.Snippet,
+				Action: func(ctx context.Context, c *cli.Command, s string) error {
+					if !slices.Contains(snippetFormats, s) {
+						return fmt.Errorf("invalid snippet format: %q", s)
+					}
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:        "sizes",
+				Value:       "100vw",
+				Usage:       "`value` of the sizes attribute on snippets",
+				Sources:     configSources("sizes"),
+				Destination: &setting.SnippetSizes,
+			},
+			&cli.StringFlag{
+				Name:        "alt",
+				Value:       "{name}",
+				Usage:       "alternative `text` on snippets; {name} and {dir} are replaced as on templates",
+				Destination: &setting.SnippetAlt,
+			},
+			&cli.BoolFlag{
+				Name:        "lazy",
+				Value:       true,
+				Usage:       "use lazy loading on snippets",
+				Sources:     configSources("lazy"),
+				Destination: &setting.SnippetLazy,
+			},
+			&cli.StringFlag{
+				Name:        "url-prefix",
+				Usage:       "`prefix` for the image URLs on snippets, e.g. /assets/img/; only the filename is appended",
+				Sources:     configSources("url-prefix"),
+				Destination: &setting.URLPrefix,
+			},
 			&cli.StringFlag{
 				Name:        "debug",
 				Aliases:     []string{"d"},
@@ -223,7 +634,7 @@ func main() {
 				Aliases:   []string{"comp"},
 				Usage:     "compresses and optimises an image",
 				UsageText: justify.Justify("You can upload any image to the Tinify API to compress it. We will automatically detect the type of image ("+strings.Join(types, ", ")+") and optimise with the TinyPNG or TinyJPG engine accordingly.\nCompression will start as soon as you upload a file or provide the URL to the image.", setting.TerminalWidth),
-				Action:    compress,
+				Action:    withRecord(compress),
 				Arguments: inputOutputFilenames,
 			},
 			{
@@ -231,52 +642,29 @@ func main() {
 				Aliases:   []string{"r"},
 				Usage:     "resizes the image to a new size, using one of the possible methods",
 				UsageText: justify.Justify("Use the API to create resized versions of your uploaded images.\nBy letting the API handle resizing you avoid having to write such code yourself and you will only have to upload your image once. The resized images will be optimally compressed with a nice and crisp appearance.\nYou can also take advantage of intelligent cropping to create thumbnails that focus on the most visually important areas of your image.\nResizing counts as one additional compression. For example, if you upload a single image and retrieve the optimized version plus 2 resized versions this will count as 3 compressions in total.\nAvailable compression methods are: "+strings.Join(methods, ", "), setting.TerminalWidth),
-				Action:    resize,
+				Action:    withRecord(resize),
 				Arguments: inputOutputFilenames,
 				Flags: []cli.Flag{
+					methodFlag,
+					widthFlag,
+					heightFlag,
 					&cli.StringFlag{
-						Name:        "method",
-						Aliases:     []string{"m"},
-						Value:       Tinify.ResizeMethodScale,
-						Usage:       "resizing method [" + strings.Join(methods, ", ") + "]",
-						Destination: &setting.Method,
-						Action: func(ctx context.Context, c *cli.Command, s string) error {
-							// Check if the resizing method is a valid one.
-							// First check if it's empty:
-							if len(setting.Method) == 0 {
-								setting.Method = Tinify.ResizeMethodScale // scale is default
-							} else if !slices.Contains(methods, setting.Method) {
-								// Checked if it's one of the valid methods; if not, abort.
-								return fmt.Errorf("invalid resize method: %q", setting.Method)
-							}
-							return nil
-						},
-					},
-					&cli.Int64Flag{
-						Name:        "width",
-						Aliases:     []string{"w"},
-						Value:       0,
-						Usage:       "destination image `width`",
-						Destination: &setting.Width,
-						Action: func(ctx context.Context, c *cli.Command, i int64) error {
-							if i < 1 {
-								return fmt.Errorf("width must be at least 1, %d provided", i)
-							}
-							return nil
-						},
+						Name:        "preset",
+						Usage:       "use the method, width and height of these comma-separated preset `names` (see \"presets list\"); several presets are all resized from a single upload",
+						Sources:     configSources("preset"),
+						Destination: &setting.Presets,
 					},
-					&cli.Int64Flag{
-						Name:        "height",
-						Aliases:     []string{"g"},
-						Value:       0,
-						Usage:       "destination image `height`",
-						Destination: &setting.Height,
-						Action: func(ctx context.Context, c *cli.Command, i int64) error {
-							if i < 1 {
-								return fmt.Errorf("height must be at least 1, %d provided", i)
-							}
-							return nil
-						},
+				},
+			},
+			{
+				Name:      "presets",
+				Usage:     "shows the named size presets for resize --preset",
+				UsageText: justify.Justify("Besides the built-in presets, more may be defined on the configuration files, either as resize specifications or as tables, e.g.:\n[presets]\nbanner = \"cover:1500x500\"\n[presets.avatar]\nmethod = \"thumb\"\nwidth = 256\nheight = 256\nPresets on the project file override those on the user file, which override the built-in ones.", setting.TerminalWidth),
+				Commands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "prints all presets, with their method, width and height",
+						Action: presetsList,
 					},
 				},
 			},
@@ -284,38 +672,21 @@ func main() {
 				Name:      "convert",
 				Aliases:   []string{"conv"},
 				Usage:     "converts from one file type to another (" + strings.Join(types, ", ") + " supported)",
-				UsageText: justify.Justify("You can use the API to convert your images to your desired image type.\nTinify currently supports converting between: "+strings.Join(types, ", ")+".\nWhen you provide more than on image type in your convert request, the smallest version will be returned to you.\nImage converting will count as one additional compression.", setting.TerminalWidth),
-				Action:    convert,
+				UsageText: justify.Justify("You can use the API to convert your images to your desired image type.\nTinify currently supports converting between: "+strings.Join(types, ", ")+".\nWhen you provide more than on image type in your convert request, the smallest version will be returned to you; with --each-type, all of them are, each written to its own file, named after its type.\nImage converting will count as one additional compression (for each type, with --each-type).", setting.TerminalWidth),
+				Action:    withRecord(convert),
 				Arguments: inputOutputFilenames,
 				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:        "type",
-						Aliases:     []string{"t"},
-						Usage:       "file type [" + strings.Join(types, ", ") + "]",
-						Value:       "webp",
-						Destination: &setting.FileType,
-						Action: func(ctx context.Context, c *cli.Command, s string) error {
-							// Check if the type(s) are all valid:
-							if setting.FileType != "" {
-								typesFound := strings.Split(setting.FileType, ",")
-								if typesFound == nil {
-									return fmt.Errorf("convert: no valid file types found")
-								}
-								// A very inefficient way of checking if all file types are valid O(n).
-								// TODO(gwyneth): See if there is already a library function for this,
-								// or use a different, linear approach.
-								for _, aFoundType := range typesFound {
-									if !slices.Contains(types, aFoundType) {
-										return fmt.Errorf("convert: invalid file format: %q", aFoundType)
-									}
-								}
-								// if we're here, all file types are valid
-								setting.Logger.Debug().Msg("convert: all file type parameters are valid")
-							} else {
-								setting.Logger.Debug().Msg("convert: no file type parameters found, trying to guess")
-							}
-							return nil
-						},
+					typeFlag,
+					backgroundFlag,
+					&cli.BoolFlag{
+						Name:        "rename",
+						Usage:       "change the extension of the output file to match the type actually returned by the API",
+						Destination: &setting.RenameOutput,
+					},
+					&cli.BoolFlag{
+						Name:        "each-type",
+						Usage:       "write one output for each file type given with --type, named after its type, instead of just the smallest one",
+						Destination: &setting.EachType,
 					},
 				},
 			},
@@ -324,24 +695,43 @@ func main() {
 				Aliases:   []string{"tr"},
 				Usage:     "processes image further (currently only replaces the background with a solid colour)",
 				UsageText: justify.Justify("If you wish to convert an image with a transparent background to one with a solid background, specify a background property in the transform object.\nIf this property is provided, the background of a transparent image will be filled (only \"white\", \"black\", or a hex value are allowed).", setting.TerminalWidth),
-				Action:    transform,
+				Action:    withRecord(transform),
+				Arguments: inputOutputFilenames,
+				Flags: []cli.Flag{
+					backgroundFlag,
+				},
+			},
+			{
+				Name:      "process",
+				Aliases:   []string{"p"},
+				Usage:     "resizes, converts and/or transforms the image, all at once",
+				UsageText: justify.Justify("Combines several operations in a single API call, so that the image is uploaded and downloaded just once, e.g.:\n--resize fit:800x600 --convert webp,avif --background white\nResize specifications are method:WIDTHxHEIGHT; with scale, only one of them is given, e.g. scale:800 or scale:x600.\nResizing and converting count as one additional compression each.", setting.TerminalWidth),
+				Action:    withRecord(process),
 				Arguments: inputOutputFilenames,
 				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "resize",
+						Usage: "resize `specification`, e.g. fit:800x600 or scale:800 [" + strings.Join(methods, ", ") + "]",
+						Action: func(ctx context.Context, c *cli.Command, s string) error {
+							_, _, _, err := parseResizeSpec(s)
+							return err
+						},
+					},
+					&cli.StringFlag{
+						Name:  "convert",
+						Usage: "file `type`(s) to convert to [" + strings.Join(types, ", ") + "]",
+						Action: func(ctx context.Context, c *cli.Command, s string) error {
+							return checkFileTypes(strings.ToLower(s))
+						},
+					},
 					&cli.StringFlag{
 						Name:        "background",
 						Aliases:     []string{"bg"},
-						Value:       "",
-						Usage:       "only \"white\", \"black\", or a hex `value` are allowed",
+						Usage:       "fill transparent backgrounds; only \"white\", \"black\", a hex `value`, or \"auto\" are allowed",
 						Destination: &setting.Transform,
 						Action: func(ctx context.Context, c *cli.Command, s string) error {
-							// Check if value passed is correct.
 							setting.Transform = strings.ToLower(setting.Transform)
-							if setting.Transform == "white" || setting.Transform == "black" {
-								return nil
-							}
-							// Just check if the rmaining string is a valid hex string.
-							// (gwyneth 20250713)
-							if !isValidHex(setting.Transform) {
+							if setting.Transform != autoBackground && !isValidBackground(setting.Transform) {
 								return fmt.Errorf("background colour: invalid hex value %q", setting.Transform)
 							}
 							return nil
@@ -349,6 +739,256 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:      "srcset",
+				Usage:     "creates a responsive image set, in several widths and file types",
+				UsageText: justify.Justify("Uploads the image once, and creates one variant for each combination of width and file type, scaled to that width, e.g.:\nsrcset --widths 320,640,1280 --formats avif,webp,jpeg photo.jpg public/img\nWidths larger than the original are skipped. A JSON manifest listing all variants is also written.\nEach variant counts as two additional compressions (resizing and converting).", setting.TerminalWidth),
+				Action:    withRecord(srcset),
+				Arguments: []cli.Argument{
+					inputOutputFilenames[0],
+					&cli.StringArg{
+						Name:        "output directory",
+						UsageText:   "output `directory` (defaults to the directory of the input file)",
+						Destination: &setting.OutputFileName,
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "widths",
+						Usage: "comma-separated list of `widths`, in pixels",
+						Value: "320,640,1280,1920",
+						Action: func(ctx context.Context, c *cli.Command, s string) error {
+							_, err := parseWidths(s)
+							return err
+						},
+					},
+					&cli.StringFlag{
+						Name:  "formats",
+						Usage: "comma-separated list of file `types` [" + strings.Join(types, ", ") + "]",
+						Value: "avif,webp,jpeg",
+					},
+					&cli.StringFlag{
+						Name:  "manifest",
+						Usage: "write the JSON manifest to `path` (default: <output directory>/<name>.srcset.json)",
+					},
+				},
+			},
+			{
+				Name:      "icons",
+				Usage:     "creates favicons and app icons in the usual sizes",
+				UsageText: justify.Justify("Uploads the image once, and creates a square PNG icon for each size, cropped to fit, e.g.:\nicons logo.png --out public/icons\nfavicon.ico (with the 16, 32 and 48 pixel icons), site.webmanifest and the <link> elements for the pages are also written.\nEach icon counts as one additional compression (resizing), or two if the image is not a PNG (resizing and converting).", setting.TerminalWidth),
+				Action:    withRecord(icons),
+				Arguments: []cli.Argument{
+					inputOutputFilenames[0],
+					&cli.StringArg{
+						Name:        "output directory",
+						UsageText:   "output `directory` (defaults to the directory of the input file)",
+						Destination: &setting.OutputFileName,
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "output `directory`, instead of giving it as an argument",
+					},
+					&cli.StringFlag{
+						Name:  "sizes",
+						Usage: "comma-separated list of icon `sizes`, in pixels",
+						Value: "16,32,48,180,192,512",
+						Action: func(ctx context.Context, c *cli.Command, s string) error {
+							_, err := parseWidths(s)
+							return err
+						},
+					},
+					&cli.StringFlag{
+						Name:  "method",
+						Usage: "`method` used to crop icons to a square [" + Tinify.ResizeMethodCover + ", " + Tinify.ResizeMethodThumb + "]",
+						Value: Tinify.ResizeMethodCover,
+						Action: func(ctx context.Context, c *cli.Command, s string) error {
+							if s = strings.ToLower(s); s != Tinify.ResizeMethodCover && s != Tinify.ResizeMethodThumb {
+								return fmt.Errorf("icons: invalid method %q", s)
+							}
+							return nil
+						},
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "`name` of the site or app on the web app manifest (defaults to the name of the input file)",
+					},
+					backgroundFlag,
+				},
+			},
+			{
+				Name:      "watch",
+				Aliases:   []string{"w"},
+				Usage:     "watches a directory tree and processes new or changed images automatically",
+				UsageText: justify.Justify("Monitors a directory tree for new or modified images ("+strings.Join(types, ", ")+") and runs them through the selected operation, once writes to them have settled down.\nBy default, outputs are written next to the originals (using --output-template, if set); use --mirror to write them to a separate tree, or --in-place to overwrite the originals.\nA ledger is kept at the root of the watched tree (unless --ledger says otherwise), so that files are not processed again after a restart, and so that the outputs are never mistaken for new images.", setting.TerminalWidth),
+				Action:    watch,
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name:        "directory",
+						UsageText:   "`directory` to watch",
+						Destination: &setting.WatchDir,
+					},
+				},
+				Flags: []cli.Flag{
+					operationFlag,
+					&cli.StringFlag{
+						Name:        "mirror",
+						Usage:       "write outputs to this `directory`, mirroring the watched tree",
+						Destination: &setting.MirrorDir,
+					},
+					&cli.BoolFlag{
+						Name:        "in-place",
+						Usage:       "overwrite the original images",
+						Destination: &setting.InPlace,
+					},
+					&cli.DurationFlag{
+						Name:        "debounce",
+						Value:       2 * time.Second,
+						Usage:       "wait this `long` after the last write before processing a file",
+						Destination: &setting.Debounce,
+					},
+					methodFlag,
+					widthFlag,
+					heightFlag,
+					typeFlag,
+					backgroundFlag,
+				},
+			},
+			{
+				Name:      "rewrite",
+				Usage:     "optimises the images referenced by HTML and Markdown files, and rewrites the references",
+				UsageText: justify.Justify("Searches a directory tree for HTML and Markdown files, and finds the local images they reference (on <img src>, srcset and ![]() alike). Each image is run through the selected operation, just once, and all references are rewritten to point to the optimised file; the originals are kept.\nExternal URLs are left alone, unless --include-remote is given, in which case those images are saved to --remote-dir.\nWith --dry-run, the changes to each document are shown as a diff, and nothing is uploaded or written.", setting.TerminalWidth),
+				Action:    rewrite,
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name:        "directory",
+						UsageText:   "root `directory` of the site",
+						Destination: &setting.SiteDir,
+					},
+				},
+				Flags: []cli.Flag{
+					operationFlag,
+					&cli.BoolFlag{
+						Name:        "hash",
+						Usage:       "use content-hashed filenames, e.g. cat.1a2b3c4d.jpg (ignored with --output-template)",
+						Destination: &setting.HashNames,
+					},
+					&cli.BoolFlag{
+						Name:        "include-remote",
+						Usage:       "also process images on external URLs",
+						Destination: &setting.IncludeRemote,
+					},
+					&cli.StringFlag{
+						Name:        "remote-dir",
+						Value:       "remote",
+						Usage:       "save remote images to this `directory`, relative to the site root",
+						Destination: &setting.RemoteDir,
+					},
+					methodFlag,
+					widthFlag,
+					heightFlag,
+					typeFlag,
+					backgroundFlag,
+				},
+			},
+			{
+				Name:      "git",
+				Usage:     "processes the images added or modified on a git repository, in place, and stages them again",
+				UsageText: justify.Justify("Finds the images which were added or modified, either on the index (--staged, the default) or since a given revision (--since), runs them through the selected operation, overwriting them atomically, and stages them again.\nImages with unstaged changes are never touched, since staging them again would mix those changes in; stage or stash them first.\nUse `git install-hook` to do all this automatically before each commit.", setting.TerminalWidth),
+				Action:    gitImages,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:        "staged",
+						Usage:       "process the images on the index (default)",
+						Destination: &setting.GitStaged,
+					},
+					&cli.StringFlag{
+						Name:        "since",
+						Usage:       "process the images changed since `revision`, including uncommitted changes",
+						Destination: &setting.GitSince,
+					},
+					operationFlag,
+					methodFlag,
+					widthFlag,
+					heightFlag,
+					backgroundFlag,
+				},
+				Commands: []*cli.Command{
+					{
+						Name:   "install-hook",
+						Usage:  "installs a pre-commit hook which runs `git --staged` before each commit",
+						Action: gitInstallHook,
+						Flags: []cli.Flag{
+							operationFlag,
+							methodFlag,
+							widthFlag,
+							heightFlag,
+							backgroundFlag,
+						},
+					},
+				},
+			},
+			{
+				Name:      "usage",
+				Usage:     "shows the compression count for the API key, and the projected usage for this month",
+				UsageText: justify.Justify("Asks the API for the current compression count, using a request which does not count as a compression, and shows it together with the free allowance still remaining this month, and a projection of the count at the end of the month, at the same rate as so far.\nEvery run which calls the API adds its compression count to a local history file (on the user cache directory), whose latest entries for this key are also shown.", setting.TerminalWidth),
+				Action:    usage,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "history",
+						Value: 10,
+						Usage: "show at most `n` history entries",
+					},
+				},
+			},
+			{
+				Name:  "key",
+				Usage: "checks the API key",
+				Commands: []*cli.Command{
+					{
+						Name:      "check",
+						Usage:     "checks whether the API key is valid, and shows its compression count",
+						UsageText: justify.Justify("Makes the request used by the API to validate keys (an upload without an image, which does not count as a compression), and reports whether the key is valid, the compression count for this month, and any error on the account, e.g. when it has run out of compressions.\nExits with status 1 if the key cannot be used.", setting.TerminalWidth),
+						Action:    keyCheck,
+					},
+				},
+			},
+			{
+				Name:      "compare",
+				Usage:     "compares two images, showing their SSIM and PSNR",
+				UsageText: justify.Justify("Decodes both images (PNG, JPEG or WebP), scales the first one to the size of the second if needed, and computes their structural similarity (SSIM, from 0 to 1, where 1 means identical) and peak signal-to-noise ratio (PSNR, in dB; 100 means identical). Nothing is uploaded.\nWith --min-ssim, exits with status 1 if the SSIM is below it.", setting.TerminalWidth),
+				ArgsUsage: "original result",
+				Action:    compareFiles,
+			},
+			{
+				Name:      "serve",
+				Usage:     "runs a local HTTP server exposing the operations as a REST service",
+				UsageText: justify.Justify("Starts an HTTP server which accepts images, either as the raw request body or as a multipart upload, on the endpoints POST /"+strings.Join(operations, ", POST /")+", and returns the processed image, together with the Image-Width, Image-Height and Compression-Count headers.\nOperation parameters are passed on the query string, e.g. POST /resize?method=fit&width=800&height=600, POST /convert?type=webp,avif, or POST /transform?background=white.\nThe server holds the API key, so that other applications do not need to know it.", setting.TerminalWidth),
+				Action:    serve,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "listen",
+						Aliases:     []string{"l"},
+						Value:       ":8080",
+						Usage:       "`address` to listen on",
+						Destination: &setting.Listen,
+					},
+				},
+			},
+			{
+				Name:      "config",
+				Usage:     "shows the configuration",
+				UsageText: justify.Justify("Settings may be read from a project file (tinify.toml or .tinify.json, on the current directory or any of its parents) and from a user file (tinify-go/config, on the user configuration directory), either in TOML or JSON format. Both may contain named profiles, e.g. [profiles.blog], selected with --profile.\nFlags take precedence over environment variables, which take precedence over the project file, which takes precedence over the user file.", setting.TerminalWidth),
+				Commands: []*cli.Command{
+					{
+						Name:   "show",
+						Usage:  "prints the resolved settings, and where they came from",
+						Action: configShow,
+					},
+				},
+			},
 			{
 				Name:    "version",
 				Aliases: []string{"v"},
@@ -385,6 +1025,26 @@ func main() {
 				setting.LoggingLevel,
 				setting.Logger.GetLevel())
 
+			// Configuration files may be broken, or may not have the selected profile.
+			if err := checkProfile(); err != nil {
+				return ctx, err
+			}
+			if len(setting.Proxy) > 0 {
+				Tinify.Proxy(setting.Proxy)
+			}
+			if len(setting.Ledger) > 0 {
+				var err error
+				if activeLedger, err = openLedger(setting.Ledger); err != nil {
+					return ctx, err
+				}
+			}
+
+			// Some commands do not call the API at all, so they don't need a key.
+			name := subcommandName(cmd)
+			if isOfflineCommand(name) {
+				return ctx, nil
+			}
+
 			// Check if key is somewhat valid, i.e. has a decent amount of chars:
 			if len(setting.Key) < 5 {
 				return ctx, fmt.Errorf("invalid Tinify API key %q; too short — please check your key and try again", setting.Key)
@@ -394,8 +1054,23 @@ func main() {
 			Tinify.SetKey(setting.Key)
 			setting.Logger.Debug().Msgf("`Before` action inside loop: a Tinify API key was found: [...%s]", setting.Key[len(setting.Key)-4:])
 
+			// `key check` does the very same, but reports it on its own.
+			if setting.VerifyKey && name != "key" && !strings.HasPrefix(name, "key ") {
+				if err := verifyKey(ctx); err != nil {
+					return ctx, err
+				}
+			}
+
 			return ctx, nil
 		},
+		After: func(ctx context.Context, cmd *cli.Command) error {
+			recordUsage()
+			// In dry-run mode, whatever would have been done has been collected by now.
+			if setting.DryRun {
+				return printPlan(os.Stdout, setting.PlanFormat)
+			}
+			return nil
+		},
 		Action: func(ctx context.Context, cmd *cli.Command) error {
 			// Everything not defined above happens here!
 			return cli.Exit(fmt.Sprintf("command %q not implemented", cmd.Name), 22)
@@ -407,11 +1082,39 @@ func main() {
 		setting.Logger.GetLevel(),
 	)
 
+	// Interrupting (e.g. with Ctrl-C) cancels the context, so that long-running commands,
+	// such as `watch`, get a chance to finish cleanly and write their reports.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	if err := cmd.Run(ctx, os.Args); err != nil {
 		setting.Logger.Fatal().Msg(err.Error())
 	}
 } // main
 
+// subcommandName returns the full name of the subcommand about to run (e.g. "git
+// install-hook"), without the name of the application. It's meant for the `Before`
+// action of the root command, which runs once all subcommands have been resolved.
+func subcommandName(root *cli.Command) string {
+	cmd := root
+	for {
+		sub := cmd.Command(cmd.Args().First())
+		if sub == nil || sub == cmd {
+			break
+		}
+		cmd = sub
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(cmd.FullName(), root.FullName()), " ")
+}
+
+// isOfflineCommand checks if a command is one of offlineCommands, or a subcommand of
+// one of them.
+func isOfflineCommand(name string) bool {
+	return slices.ContainsFunc(offlineCommands, func(offline string) bool {
+		return name == offline || strings.HasPrefix(name, offline+" ")
+	})
+}
+
 // openStream attempts to open a file, stdin, or a URL, and passes the image along for
 // processing by the API.
 func openStream(ctx context.Context) (context.Context, *Tinify.Source, error) {
@@ -429,6 +1132,10 @@ func openStream(ctx context.Context) (context.Context, *Tinify.Source, error) {
 
 	// Tweak command-line to deal with files as parameters without --input etc.
 
+	// Whatever happens from now on gets reported.
+	beginRecord(setting.ImageName, setting.OutputFileName)
+	originalImage, chosenBackground, imagePlaceholder = nil, "", nil
+
 	// Now check for the special "-" which also denotes STDIN:
 	if setting.ImageName == "-" {
 		setting.ImageName = ""
@@ -463,6 +1170,15 @@ func openStream(ctx context.Context) (context.Context, *Tinify.Source, error) {
 		if b, dErr := isDirWritable(writeDir); !b {
 			return ctx, nil, fmt.Errorf("cannot save to %q, error was: %q", setting.OutputFileName, dErr)
 		}
+	} else if setting.OutputTemplate != "" {
+		// The output filename will only be known after the API call, but, most of the time,
+		// the directory can be figured out in advance.
+		writeDir := filepath.Dir(expandOutputTemplate(setting.OutputTemplate, setting.ImageName, nil))
+		if !strings.Contains(writeDir, "{") {
+			if b, dErr := isDirWritable(writeDir); !b {
+				return ctx, nil, fmt.Errorf("cannot save to %q, error was: %q", writeDir, dErr)
+			}
+		}
 	}
 	// At this point, the output is either a valid filename or STDOUT. (see above)
 	setting.Logger.Trace().Msgf("openStream: output file is %q", setting.OutputFileName)
@@ -493,16 +1209,36 @@ func openStream(ctx context.Context) (context.Context, *Tinify.Source, error) {
 			return ctx, nil, err
 		}
 		// check canonical mime type:
-		mimeType := http.DetectContentType(rawImage)
-		// Valid Media Types according to IANA (se https://www.iana.org/assignments/media-types/media-types.xhtml#image)
-		switch mimeType {
-		case "image/png", "image/apng", "image/vnd.mozilla.apng", "image/vnd.sealed.png", "image/jpeg", "image/webp", "image/avif":
-			setting.Logger.Trace().Msgf("openStream: setting Media Type to (valid) %q", mimeType)
-		default:
+		mimeType := detectMediaType(rawImage)
+		if !isSupportedMediaType(mimeType) {
 			return ctx, nil, fmt.Errorf("openStream: invalid or not recognised Media Type %q, aborting", mimeType)
 		}
+		setting.Logger.Trace().Msgf("openStream: setting Media Type to (valid) %q", mimeType)
 
 		setting.Logger.Debug().Msgf("openStream: arg: %q (empty means stdin), size %d, Media Type %q", setting.ImageName, len(rawImage), mimeType)
+		current.BytesBefore = int64(len(rawImage))
+		originalImage = rawImage
+
+		// Images which were processed before, and did not change since, are skipped;
+		// this only makes sense when writing to a file, though.
+		if activeLedger != nil && len(setting.ImageName) > 0 && (len(setting.OutputFileName) > 0 || len(setting.OutputTemplate) > 0) {
+			if err = activeLedger.check(setting.ImageName, rawImage); err != nil {
+				setting.Logger.Debug().Msgf("openStream: %q %s", setting.ImageName, err)
+				endRecord(err)
+				return ctx, nil, err
+			}
+		}
+		// Likewise for images marked by us, wherever they came from.
+		if err = checkMarker(rawImage); err != nil {
+			endRecord(err)
+			return ctx, nil, err
+		}
+
+		// All local checks have been done; in dry-run mode, that's as far as we go.
+		if setting.DryRun {
+			addPlanItem(setting.ImageName, setting.OutputFileName, mimeType, int64(len(rawImage)))
+			return ctx, nil, errDryRun
+		}
 
 		// Now call the TinyPNG API
 		source, err = Tinify.FromBuffer(rawImage)
@@ -512,6 +1248,10 @@ func openStream(ctx context.Context) (context.Context, *Tinify.Source, error) {
 	} else {
 		// we're assuming that we've got a valid URL, which might *not* be the case!
 		// TODO(Tasker): extra validation
+		if setting.DryRun {
+			addPlanItem(setting.ImageName, setting.OutputFileName, "", 0)
+			return ctx, nil, errDryRun
+		}
 		source, err = Tinify.FromUrl(setting.ImageName)
 		if err != nil {
 			return ctx, nil, err
@@ -522,24 +1262,63 @@ func openStream(ctx context.Context) (context.Context, *Tinify.Source, error) {
 
 // All-purpose API call. Whatever is done, it happens on the globals.
 func callAPI(_ context.Context, cmd *cli.Command, source *Tinify.Source) error {
-	var (
-		err      error  // declared here due to scope issues.
-		rawImage []byte // raw image file, when loaded from disk.
-	)
-
 	if len(cmd.Name) == 0 {
 		return fmt.Errorf("no command")
 	}
 	setting.Logger.Debug().Msgf("inside callAPI(), invoked by %q", cmd.Name)
 
+	// Warning: `source` is a global variable in this context!.
+	result, err := source.Result()
+	if err != nil {
+		setting.Logger.Error().Err(err)
+		return err
+	}
+	return writeResult(source, result)
+}
+
+// writeResult writes what the API returned to the output file (or STDOUT), unless
+// it's not worth keeping, and reports it.
+func writeResult(source *Tinify.Source, result *Tinify.Result) (err error) {
+	setting.CompressionCount = result.CompressionCount()
+	// Remember it for the next dry run.
+	if err = saveCompressionCount(setting.CompressionCount); err != nil {
+		setting.Logger.Debug().Msgf("callAPI: could not save the compression count: %s", err)
+	}
+
+	// With no explicit output filename, but with a template, we can only now
+	// figure out the filename, since it may depend on the result.
+	outputFileName := setting.OutputFileName
+	if len(outputFileName) == 0 && len(setting.OutputTemplate) > 0 {
+		outputFileName = expandOutputTemplate(setting.OutputTemplate, setting.ImageName, result)
+		setting.Logger.Debug().Msgf("callAPI: output template %q expanded to %q", setting.OutputTemplate, outputFileName)
+	}
+
+	// The API may have returned some other type than the filename implies, e.g. when
+	// converting to several types.
+	if setting.RenameOutput && len(setting.OutputFileName) > 0 && setting.OutputFileName != "-" {
+		if renamed := matchExtension(outputFileName, result.MediaType()); renamed != outputFileName {
+			setting.Logger.Info().Msgf("writeResult: got %s; writing to %q instead of %q", result.MediaType(), renamed, outputFileName)
+			outputFileName = renamed
+		}
+	}
+
+	setting.LastOutput = outputFileName
+	resultRecord(source, result, outputFileName)
+	if err = checkGain(source, result, outputFileName); err != nil {
+		return err
+	}
+	if err = checkQuality(source, result, outputFileName); err != nil {
+		return err
+	}
+	addPlaceholder(source, result)
+	// What actually gets written, which may include our marker.
+	rawImage := outputData(result)
+
 	// If we have no explicit output filename, write directly to stdout.
-	if len(setting.OutputFileName) == 0 {
+	if len(outputFileName) == 0 {
 		setting.Logger.Debug().Msg("callAPI: no output filename; writing to stdout instead")
-		// Warning: `source` is a global variable in this context!.
-		rawImage, setting.CompressionCount, err = source.ToBufferC()
-		if err != nil {
-			setting.Logger.Error().Err(err)
-			return err
+		if len(rawImage) == 0 {
+			return fmt.Errorf("result returned zero bytes")
 		}
 		// rawImage contains the raw image data; we push it out to STDOUT.
 		n, err := os.Stdout.Write(rawImage)
@@ -552,16 +1331,28 @@ func callAPI(_ context.Context, cmd *cli.Command, source *Tinify.Source) error {
 		return nil
 	}
 
-	setting.Logger.Debug().Msgf("callAPI: opening file %q for outputting image", setting.OutputFileName)
+	setting.Logger.Debug().Msgf("callAPI: opening file %q for outputting image", outputFileName)
 
-	// write to file, we have a special function for that already defined:
-	setting.CompressionCount, err = source.ToFileC(setting.OutputFileName)
-	if err != nil {
+	// Write to a temporary file first, so that, when overwriting the original image,
+	// it never gets left half-written.
+	if err = writeFileAtomic(outputFileName, rawImage); err != nil {
 		setting.Logger.Error().Err(err)
 		return err
 	}
+	emitSnippet(outputFileName, []snippetImage{{
+		Path:      outputFileName,
+		Width:     result.Width(),
+		Height:    result.Height(),
+		MediaType: result.MediaType(),
+	}})
+
+	if activeLedger != nil {
+		if err = activeLedger.record(outputFileName, rawImage); err != nil {
+			setting.Logger.Error().Msgf("callAPI: could not update the ledger: %s", err)
+		}
+	}
 
-	setting.Logger.Info().Msgf("Succesfully wrote to %q, compression count: %d", setting.OutputFileName, setting.CompressionCount)
+	setting.Logger.Info().Msgf("Succesfully wrote to %q, compression count: %d", outputFileName, setting.CompressionCount)
 	return nil
 }
 
@@ -572,76 +1363,134 @@ func convert(ctx context.Context, cmd *cli.Command) error {
 		source *Tinify.Source
 	)
 
+	setting.Operation = "convert"
 	setting.Logger.Debug().Msgf("convert called, conversion type request was %q", setting.FileType)
 
-	// If setting.FileType is empty, do a complex lookup to figure out what we ought to convert it to.
-	// If all else fails, use WebP as the default (e.g., when stdout is selected, as there is no way to guess).
-	if setting.FileType == "" {
-		// check extension
-		if setting.OutputFileName != "" {
-			extension := strings.ToLower(filepath.Ext(setting.OutputFileName))
-			if len(extension) > 1 { // skip dot before extension!
-				// check if it's one that the Tinify API recognises as valid:
-				if !slices.Contains(types, extension[1:]) {
-					setting.FileType = extension[1:]
-					setting.Logger.Trace().Msgf("convert: conversion type request was empty, now set to valid file extension %q", setting.FileType)
-				}
-			}
+	// Without an explicit type (on the command line, the environment or a configuration
+	// file), figure it out from the output filename; WebP is only used when that's not
+	// possible (e.g. when writing to STDOUT).
+	if !cmd.IsSet("type") {
+		fileType, err := inferConvertType(setting.OutputFileName, setting.OutputTemplate)
+		if err != nil {
+			return err
 		}
+		setting.FileType = fileType
+		setting.Logger.Debug().Msgf("convert: no file type requested; using %q", setting.FileType)
 	}
-	// this could be written differently, avoiding the comparison, but this code
-	// is cleaner: if we didn't manage to set it earlier, we set it now to the default, webp:
-	if setting.FileType == "" {
-		setting.FileType = "webp"
-		setting.Logger.Trace().Msg("convert: conversion type request was not set, using \"webp\" as default")
+
+	types := strings.Split(strings.ToLower(setting.FileType), ",")
+	if setting.EachType {
+		if err = variantTemplate("convert", "--each-type", ".{ext}", "{ext}", "{type}"); err != nil {
+			return err
+		}
 	}
 
-	if ctx, source, err = openStream(ctx); err != nil {
+	if ctx, source, err = openStream(ctx); errors.Is(err, errDryRun) {
+		if setting.EachType {
+			// One upload, plus one conversion per type.
+			setPlanCompressions(1 + int64(len(types)))
+		}
+		return nil
+	} else if isSkipped(err) {
+		return nil
+	} else if err != nil {
 		setting.Logger.Error().Msgf("convert: invalid filenames, error was %q", err)
 		return err
 	}
 
-	// user can request conversion to multiple file types, comma-separated; we need to split
-	// these since our Convert logic presumes maps of strings, to properly JSONificta them,
-	if err := source.Convert(strings.Split(strings.ToLower(setting.FileType), ",")); err != nil {
+	if setting.EachType {
+		return convertEach(source, types)
+	}
+	if err := applyOperation(source, "convert", &setting, originalImage); err != nil {
 		return err
 	}
 	// again, note that `source` is a global.
 	return callAPI(ctx, cmd, source)
 }
 
+// convertEach converts the uploaded image to each of the file types, and writes each
+// result on its own, as soon as it arrives; if one of the conversions fails, those which
+// were done already (and paid for) are kept.
+func convertEach(source *Tinify.Source, types []string) error {
+	signatures := outputSignatures()
+	return eachOutput(len(types), func(i int) (int64, error) {
+		if activeLedger != nil && activeLedger.pending != nil {
+			// Each type is a different operation, as far as the ledger is concerned; those
+			// converted on an earlier run are not converted (and paid for) again.
+			activeLedger.pending.Operations = signatures[i]
+			if err := activeLedger.upToDate(activeLedger.pending.Path, activeLedger.pending.InputHash, signatures[i]); err != nil {
+				return 0, err
+			}
+		}
+		// Each type gets its own variant, so that only JPEG gets a background.
+		v := source.Variant()
+		if err := v.Convert(types[i : i+1]); err != nil {
+			return 0, err
+		}
+		if err := fillBackground(v, originalImage, types[i:i+1], &setting); err != nil {
+			return 0, err
+		}
+		result, err := v.Result()
+		if err != nil {
+			return 0, fmt.Errorf("convert: conversion to %s failed: %w", types[i], err)
+		}
+		return 1, writeResult(source, result)
+	})
+}
+
 // Resizes image, given a width and a height.
 func resize(ctx context.Context, cmd *cli.Command) error {
 	var (
 		err    error // declared here due to scope issues.
 		source *Tinify.Source
 	)
+	setting.Operation = "resize"
+
+	// Presets replace whatever method, width and height were given.
+	var presets []resizePreset
+	if len(setting.Presets) > 0 {
+		if presets, err = lookupPresets(setting.Presets); err != nil {
+			return err
+		}
+		usePreset(presets[0])
+		if len(presets) > 1 {
+			if err = variantTemplate("resize", "several presets", "-{preset}.{ext}", "{preset}"); err != nil {
+				return err
+			}
+		}
+	}
 	setting.Logger.Debug().Msgf("resize called; debug is %q, method is %q, width is %d px, height is %d px",
 		setting.LoggingLevel, setting.Method, setting.Width, setting.Height)
 
 	// width and height are globals.
-	if setting.Width == 0 && setting.Height == 0 {
-		setting.Logger.Error().Msg("resize: width and height cannot be simultaneously zero")
-		return fmt.Errorf("resize: width and height cannot be simultaneously zero")
+	if err = checkOperation("resize", &setting); err != nil {
+		setting.Logger.Error().Msg(err.Error())
+		return err
 	}
 
 	setting.Logger.Debug().Msg("resize: now calling openStream()")
 
-	if ctx, source, err = openStream(ctx); err != nil {
+	if ctx, source, err = openStream(ctx); errors.Is(err, errDryRun) {
+		if len(presets) > 1 {
+			// Each preset is resized on its own.
+			setPlanCompressions(1 + int64(len(presets)))
+		}
+		return nil
+	} else if isSkipped(err) {
+		return nil
+	} else if err != nil {
 		setting.Logger.Error().Msgf("resize: invalid filenames, error was %v", err)
 		return err
 	}
 
+	if len(presets) > 1 {
+		return resizeEach(source, presets)
+	}
+
 	setting.Logger.Debug().Msg("resize: now calling source.Resize()")
 
 	// method is a global too.
-	err = source.Resize(&Tinify.ResizeOption{
-		Method: Tinify.ResizeMethod(setting.Method),
-		Width:  setting.Width, // replace by real value!
-		Height: setting.Height,
-	})
-
-	if err != nil {
+	if err = applyOperation(source, "resize", &setting, originalImage); err != nil {
 		setting.Logger.Error().Err(err)
 		return err
 	}
@@ -665,9 +1514,12 @@ func compress(ctx context.Context, cmd *cli.Command) error {
 			}
 		}
 	*/
+	setting.Operation = "compress"
 	setting.Logger.Debug().Msgf("compress called for %q -> %q", setting.ImageName, setting.OutputFileName)
 
-	if ctx, source, err = openStream(ctx); err != nil {
+	if ctx, source, err = openStream(ctx); errors.Is(err, errDryRun) || isSkipped(err) {
+		return nil
+	} else if err != nil {
 		return cli.Exit(fmt.Sprintf("compress: invalid filenames, error was: %v", err), 2)
 	}
 
@@ -681,24 +1533,128 @@ func transform(ctx context.Context, cmd *cli.Command) error {
 		source *Tinify.Source
 	)
 
+	setting.Operation = "transform"
 	setting.Logger.Debug().Msg("transform called")
-	if len(setting.Transform) == 0 {
-		return fmt.Errorf("transform: empty transformation type passed")
+	if err = checkOperation("transform", &setting); err != nil {
+		return err
 	}
 
-	if ctx, source, err = openStream(ctx); err != nil {
+	if ctx, source, err = openStream(ctx); errors.Is(err, errDryRun) || isSkipped(err) {
+		return nil
+	} else if err != nil {
 		setting.Logger.Error().Msgf("transform: invalid filenames, error was %v", err)
 		return err
 	}
 
-	if err = source.Transform(&Tinify.TransformOptions{
-		Background: setting.Transform,
-	}); err != nil {
+	if err = applyOperation(source, "transform", &setting, originalImage); err != nil {
 		return err
 	}
 	return callAPI(ctx, cmd, source)
 }
 
+// checkOperation does some basic validation of the settings for an operation,
+// before anything gets uploaded to the API, to avoid wasting a compression.
+func checkOperation(operation string, s *Setting) error {
+	switch operation {
+	case "compress", "convert":
+		return nil
+	case "resize":
+		if s.Width == 0 && s.Height == 0 {
+			return fmt.Errorf("resize: width and height cannot be simultaneously zero")
+		}
+		if err := checkResize(s.Method, s.Width, s.Height); err != nil {
+			return fmt.Errorf("resize: %w", err)
+		}
+		return nil
+	case "transform":
+		if len(s.Transform) == 0 {
+			return fmt.Errorf("transform: empty transformation type passed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operation %q", operation)
+}
+
+// checkResize makes sure that the resizing method gets the dimensions it takes, before
+// anything gets uploaded: scaling takes either the width or the height, all other
+// methods take both.
+func checkResize(method string, width, height int64) error {
+	switch {
+	case !slices.Contains(methods, method):
+		return fmt.Errorf("invalid resize method %q", method)
+	case width < 0 || height < 0:
+		return fmt.Errorf("width and height cannot be negative")
+	case method == Tinify.ResizeMethodScale && (width == 0) == (height == 0):
+		return fmt.Errorf("scaling takes either a width or a height, but not both")
+	case method != Tinify.ResizeMethodScale && (width == 0 || height == 0):
+		return fmt.Errorf("%s takes both a width and a height", method)
+	}
+	return nil
+}
+
+// applyOperation adds the commands for one operation to the source, using the
+// values taken from the settings; the original image, if known, is checked for
+// transparency before converting.
+func applyOperation(source *Tinify.Source, operation string, s *Setting, original []byte) error {
+	switch operation {
+	case "compress":
+		// Nothing to do: compressing is what happens on upload.
+		return nil
+	case "resize":
+		return source.Resize(&Tinify.ResizeOption{
+			Method: Tinify.ResizeMethod(s.Method),
+			Width:  s.Width,
+			Height: s.Height,
+		})
+	case "convert":
+		// user can request conversion to multiple file types, comma-separated; we need to split
+		// these since our Convert logic presumes maps of strings, to properly JSONificta them,
+		fileTypes := strings.Split(strings.ToLower(s.FileType), ",")
+		if err := source.Convert(fileTypes); err != nil {
+			return err
+		}
+		return fillBackground(source, original, fileTypes, s)
+	case "transform":
+		background, err := resolveBackground(s)
+		if err != nil {
+			return err
+		}
+		return source.Transform(&Tinify.TransformOptions{
+			Background: background,
+		})
+	}
+	return fmt.Errorf("unknown operation %q", operation)
+}
+
+// fillBackground makes sure that images with transparency converted to JPEG get a solid
+// background, from --background, or --jpeg-background if none was given; otherwise, the
+// API would fail, or fill it with whatever it sees fit. Chains which include a transform
+// already have a background, and remote images (with no original) cannot be checked.
+func fillBackground(source *Tinify.Source, original []byte, fileTypes []string, s *Setting) error {
+	if slices.Contains(strings.Split(s.Operation, "+"), "transform") || original == nil {
+		return nil
+	}
+	// With --background auto, the colour is only picked (and reported) if it's needed.
+	background := s.JPEGBackground
+	var resolveErr error
+	added, err := source.FillBackground(original, fileTypes, func() (string, error) {
+		if len(s.Transform) > 0 {
+			background, resolveErr = resolveBackground(s)
+		}
+		return background, resolveErr
+	})
+	switch {
+	case resolveErr != nil:
+		return resolveErr
+	case err != nil:
+		// E.g. AVIF, which cannot be decoded; let the API deal with it.
+		setting.Logger.Warn().Msgf("fillBackground: cannot check %q for transparency: %s", s.ImageName, err)
+	case added:
+		setting.Logger.Info().Msgf("fillBackground: %q has transparent pixels; filling them with %q for JPEG", s.ImageName, background)
+	}
+	return nil
+}
+
 // Aux functions
 
 // setLogLevel is just a macro-style thing to force the logging level to be set.
@@ -729,6 +1685,34 @@ func setLogLevel() error {
 		setting.LoggingLevel, setting.Logger.GetLevel())
 }
 
+// checkFileTypes checks if all the comma-separated file types are valid for conversion.
+func checkFileTypes(fileTypes string) error {
+	typesFound := strings.Split(fileTypes, ",")
+	if len(typesFound) == 0 {
+		return fmt.Errorf("convert: no valid file types found")
+	}
+	// A very inefficient way of checking if all file types are valid O(n).
+	// TODO(gwyneth): See if there is already a library function for this,
+	// or use a different, linear approach.
+	for _, aFoundType := range typesFound {
+		if !slices.Contains(types, aFoundType) {
+			return fmt.Errorf("convert: invalid file format: %q", aFoundType)
+		}
+	}
+	return nil
+}
+
+// isValidBackground checks if the (lowercase) background colour for a transform
+// is one of the values accepted by the Tinify API: "white", "black", or a hex value.
+func isValidBackground(background string) bool {
+	if background == "white" || background == "black" {
+		return true
+	}
+	// Just check if the rmaining string is a valid hex string.
+	// (gwyneth 20250713)
+	return isValidHex(background)
+}
+
 // check if this is a valid Hex value for a colour or not.
 // allow CSS RGB types of colours, with or without #
 // 3 digits, 6 digits, or 8 digits (for transpareny) accepted.
@@ -764,6 +1748,62 @@ func isValidHex(s string) bool {
 	return true
 }
 
+// writeFileAtomic writes data to a temporary file on the same directory, and then
+// renames it to the final path, so that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// Harmless if the rename succeeded.
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	// Same permissions as Tinify.Result.ToFile().
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// hashBytes returns the SHA-256 of some data, as a hex string.
+func hashBytes(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// detectMediaType works out the Media Type of an image, as http.DetectContentType does,
+// except that it also recognises AVIF, by the brands on its ftyp box.
+func detectMediaType(data []byte) string {
+	if len(data) >= 16 && string(data[4:8]) == "ftyp" {
+		size := min(int(binary.BigEndian.Uint32(data[0:4])), len(data))
+		// Major brand, then (after the minor version) the compatible brands.
+		for i := 8; i+4 <= size; i += 4 {
+			if brand := string(data[i : i+4]); i != 12 && (brand == "avif" || brand == "avis") {
+				return "image/avif"
+			}
+		}
+	}
+	return http.DetectContentType(data)
+}
+
+// isSupportedMediaType checks if the Media Type (as detected by detectMediaType)
+// is one of those that the Tinify API accepts.
+func isSupportedMediaType(mimeType string) bool {
+	// Valid Media Types according to IANA (se https://www.iana.org/assignments/media-types/media-types.xhtml#image)
+	switch mimeType {
+	case "image/png", "image/apng", "image/vnd.mozilla.apng", "image/vnd.sealed.png", "image/jpeg", "image/webp", "image/avif":
+		return true
+	}
+	return false
+}
+
 // A stupid way (which works) to check if a directory is writable by this user or not.
 // The advantage is that it works universally on all operating systems.
 func isDirWritable(path string) (bool, error) {
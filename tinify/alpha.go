@@ -0,0 +1,55 @@
+package Tinify
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg" // registers the decoders used by image.Decode.
+	_ "image/png"
+	"slices"
+
+	_ "golang.org/x/image/webp"
+)
+
+// HasTransparency decodes an image (PNG, JPEG or WebP) and reports whether any
+// of its pixels is not fully opaque.
+func HasTransparency(data []byte) (bool, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	// All the image types of the standard library know how to check this quickly.
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque(), nil
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// FillBackground adds a Transform with a background to the source, if converting the
+// original image to any of the file types would lose its transparency, i.e. if one of
+// them is JPEG, and the image has any pixels which are not fully opaque. The background
+// colour is only asked for then, since working it out may take some effort. It reports
+// whether the background was added.
+func (s *Source) FillBackground(original []byte, types []string, background func() (string, error)) (bool, error) {
+	if !slices.Contains(types, "jpeg") {
+		return false, nil
+	}
+	transparent, err := HasTransparency(original)
+	if err != nil || !transparent {
+		return false, err
+	}
+	colour, err := background()
+	if err != nil {
+		return false, err
+	}
+	return true, s.Transform(&TransformOptions{
+		Background: colour,
+	})
+}
@@ -0,0 +1,55 @@
+// Tests for transparency detection.
+package Tinify
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// Checks that only images with some pixel which is not fully opaque count as having
+// transparency.
+func TestHasTransparency(t *testing.T) {
+	opaque := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 0xff
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	copy(transparent.Pix, opaque.Pix)
+	transparent.Pix[len(transparent.Pix)-1] = 0x80
+
+	var pngOpaque, pngTransparent, jpg bytes.Buffer
+	if err := png.Encode(&pngOpaque, opaque); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngTransparent, transparent); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpg, opaque, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var alphaTests = []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"opaque PNG", pngOpaque.Bytes(), false},
+		{"transparent PNG", pngTransparent.Bytes(), true},
+		{"JPEG", jpg.Bytes(), false},
+	}
+	for _, tc := range alphaTests {
+		got, err := HasTransparency(tc.data)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: transparency is %v, expected %v", tc.name, got, tc.want)
+		}
+	}
+	if _, err := HasTransparency([]byte("not an image")); err == nil {
+		t.Fatalf("checked garbage for transparency, and got no error")
+	}
+}
@@ -2,6 +2,7 @@ package Tinify
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,9 +22,13 @@ var tinifyProxyTransport *http.Transport
 
 // Type for the TinyPNG API client.
 type Client struct {
-	options map[string]any // List of options to call the Tinify API.
-	key     string         // TinyPNG API key.
-	proxy   string         // Specific HTTP(S) proxy server for this client.
+	options        map[string]any    // List of options to call the Tinify API.
+	key            string            // TinyPNG API key.
+	proxy          string            // Specific HTTP(S) proxy server for this client.
+	transport      *http.Transport   // Transport for this client, configured with its proxy.
+	transportProxy string            // Proxies the transport was configured with.
+	roundTripper   http.RoundTripper // Set with SetTransport, replacing the above.
+	mu             sync.Mutex        // Guards the transport.
 }
 
 // Creates a new TinyPNG API client by allocating some memory for it.
@@ -34,19 +40,21 @@ func NewClient(key string) (c *Client, err error) {
 
 // HTTP(S) request which can either send raw bytes (for an image) and/or a JSON-formatted request.
 func (c *Client) Request(method string, urlRequest string, body any) (response *http.Response, err error) {
+	return c.RequestContext(context.Background(), method, urlRequest, body)
+}
+
+// RequestContext is like Request, but the request is cancelled when ctx is done.
+func (c *Client) RequestContext(ctx context.Context, method string, urlRequest string, body any) (response *http.Response, err error) {
 	// NOTE: this should go through a bit more validation. We are deferring such
 	// validation to the Go library functions that do the actual request.
 	if !strings.HasPrefix(urlRequest, "https") { // shouldn't we check for uppercase as well? (gwyneth 20231111)
 		urlRequest = API_ENDPOINT + urlRequest
 	}
-	// Deal with HTTP(S) proxy for this request.
-	tinifyProxyTransport.Proxy = c.reconfigureProxyTransport("") // the parameter is possibly irrelevant
-
 	httpClient := http.Client{
-		Transport: tinifyProxyTransport,
+		Transport: c.currentTransport(),
 	}
 
-	req, err := http.NewRequest(method, urlRequest, nil)
+	req, err := http.NewRequestWithContext(ctx, method, urlRequest, nil)
 	if err != nil {
 		return nil, fmt.Errorf("request to %q using method %q failed; error was: %s", urlRequest, method, err)
 	}
@@ -80,6 +88,36 @@ func (c *Client) Request(method string, urlRequest string, body any) (response *
 	return
 }
 
+// SetTransport makes the client send its requests through rt, instead of the shared
+// transport configured with the proxy, e.g. to add some middleware, or to test against
+// a fake API. Setting it to nil goes back to the shared transport.
+func (c *Client) SetTransport(rt http.RoundTripper) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roundTripper = rt
+}
+
+// currentTransport returns the transport for the next request. Dealing with the HTTP(S)
+// proxy is done on a copy of the shared transport, since changing it on every request is
+// not safe when several requests are made concurrently; the copy is only replaced when
+// the proxy changes.
+func (c *Client) currentTransport() http.RoundTripper {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.roundTripper != nil {
+		return c.roundTripper
+	}
+	if proxies := proxy + " " + c.proxy; c.transport == nil || proxies != c.transportProxy {
+		if c.transport != nil {
+			c.transport.CloseIdleConnections()
+		}
+		c.transport = tinifyProxyTransport.Clone()
+		c.transport.Proxy = c.reconfigureProxyTransport("") // the parameter is possibly irrelevant
+		c.transportProxy = proxies
+	}
+	return c.transport
+}
+
 // Attempts to reconfigure an _existing_ Transport with a proxy.
 func (c *Client) reconfigureProxyTransport(proxyURL string) func(*http.Request) (*url.URL, error) {
 	reqProxy := http.ProxyURL(nil) // set to no proxy first.
@@ -0,0 +1,18 @@
+// Helpers shared by the tests of the library.
+package Tinify
+
+import (
+	"testing"
+
+	"github.com/gwpp/tinify-go/tinify/tinifytest"
+)
+
+// useFakeAPI makes the client call a fake API for the rest of the test.
+func useFakeAPI(t *testing.T) *tinifytest.API {
+	t.Helper()
+	api := &tinifytest.API{}
+	SetKey("test")
+	GetClient().SetTransport(api)
+	t.Cleanup(func() { GetClient().SetTransport(nil) })
+	return api
+}
@@ -0,0 +1,109 @@
+// Icon sets: favicons and app icons in several sizes, retrieved from a single
+// upload, plus a multi-resolution ICO file assembled locally.
+package Tinify
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+)
+
+// Sizes of the usual favicons and app icons: browser tabs (16, 32, 48), the Apple
+// touch icon (180), and the Android/PWA icons (192, 512).
+var IconSizes = []int64{16, 32, 48, 180, 192, 512}
+
+// One of the images in an icon set.
+type IconVariant struct {
+	Size   int64   // Requested width and height.
+	Result *Result // What the API returned, always a PNG.
+}
+
+// Icons retrieves one square PNG of the image for each size, cropped with the given
+// method (ResizeMethodCover or ResizeMethodThumb). If background is not empty,
+// transparent pixels are filled with it (see Transform).
+// Note that each icon counts as one additional compression (resize), or two if the
+// uploaded image was not a PNG (resize and convert).
+func (s *Source) Icons(sizes []int64, method ResizeMethod, background string) ([]IconVariant, error) {
+	if len(sizes) == 0 {
+		return nil, errors.New("icons require at least one size")
+	}
+	if method != ResizeMethodCover && method != ResizeMethodThumb {
+		return nil, fmt.Errorf("icons can only be cropped with %q or %q, not %q", ResizeMethodCover, ResizeMethodThumb, method)
+	}
+
+	variants := make([]IconVariant, 0, len(sizes))
+	for _, size := range slices.Compact(slices.Sorted(slices.Values(sizes))) {
+		v := s.Variant()
+		if err := v.Resize(&ResizeOption{
+			Method: method,
+			Width:  size,
+			Height: size,
+		}); err != nil {
+			return variants, err
+		}
+		if s.shrink.Input.Type != "image/png" {
+			if err := v.Convert([]string{"png"}); err != nil {
+				return variants, err
+			}
+		}
+		if len(background) > 0 {
+			if err := v.Transform(&TransformOptions{Background: background}); err != nil {
+				return variants, err
+			}
+		}
+		result, err := v.toResult()
+		if err != nil {
+			return variants, fmt.Errorf("icon at %dx%d failed: %w", size, size, err)
+		}
+		variants = append(variants, IconVariant{
+			Size:   size,
+			Result: result,
+		})
+	}
+	return variants, nil
+}
+
+// EncodeICO assembles a multi-resolution ICO file out of PNG images, which are
+// embedded as they are; none of them may be larger than 256x256.
+func EncodeICO(pngs [][]byte) ([]byte, error) {
+	if len(pngs) == 0 {
+		return nil, errors.New("an ICO file requires at least one image")
+	}
+
+	// ICONDIR header, followed by one ICONDIRENTRY per image, and then the images.
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, [3]uint16{0, 1, uint16(len(pngs))})
+	offset := 6 + 16*len(pngs)
+	for i, data := range pngs {
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("ICO image #%d: %w", i+1, err)
+		}
+		if format != "png" {
+			return nil, fmt.Errorf("ICO image #%d is %s, not PNG", i+1, format)
+		}
+		if config.Width > 256 || config.Height > 256 {
+			return nil, fmt.Errorf("ICO image #%d is %dx%d, larger than 256x256", i+1, config.Width, config.Height)
+		}
+		binary.Write(&buf, binary.LittleEndian, struct {
+			Width, Height, Colours, Reserved uint8
+			Planes, BitCount                 uint16
+			Size, Offset                     uint32
+		}{
+			Width:    uint8(config.Width), // 256 wraps around to 0, which is what ICO uses.
+			Height:   uint8(config.Height),
+			Planes:   1,
+			BitCount: 32,
+			Size:     uint32(len(data)),
+			Offset:   uint32(offset),
+		})
+		offset += len(data)
+	}
+	for _, data := range pngs {
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,118 @@
+// Tests for favicons and app icons.
+package Tinify
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+// Checks the header, directory and images of ICO files, that only PNG images of up to
+// 256 pixels are accepted.
+func TestEncodeICO(t *testing.T) {
+	encode := func(size int, jpg bool) []byte {
+		var buf bytes.Buffer
+		img := image.NewNRGBA(image.Rect(0, 0, size, size))
+		var err error
+		if jpg {
+			err = jpeg.Encode(&buf, img, nil)
+		} else {
+			err = png.Encode(&buf, img)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	small, large := encode(16, false), encode(256, false)
+	ico, err := EncodeICO([][]byte{small, large})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ico) != 6+2*16+len(small)+len(large) {
+		t.Fatalf("ICO has %d byte(s), expected %d", len(ico), 6+2*16+len(small)+len(large))
+	}
+	// Header: reserved, type (1 for icons), number of images.
+	if !bytes.Equal(ico[:6], []byte{0, 0, 1, 0, 2, 0}) {
+		t.Fatalf("unexpected ICO header % x", ico[:6])
+	}
+	// 256 pixels are written as 0; the first image comes right after the entries.
+	if ico[6] != 16 || ico[6+16] != 0 || ico[6+12] != 6+2*16 {
+		t.Fatalf("unexpected ICO entries % x", ico[6:6+2*16])
+	}
+	if !bytes.Equal(ico[6+2*16:6+2*16+len(small)], small) {
+		t.Fatalf("first image not embedded as it is")
+	}
+
+	for name, images := range map[string][][]byte{
+		"none":      nil,
+		"JPEG":      {encode(16, true)},
+		"too large": {encode(300, false)},
+	} {
+		if _, err := EncodeICO(images); err == nil {
+			t.Fatalf("%s: got no error", name)
+		}
+	}
+}
+
+// Checks that icons are square PNG images of each size, once per size, and that they
+// are only converted if the upload was not a PNG.
+func TestIcons(t *testing.T) {
+	api := useFakeAPI(t)
+	var iconTests = []struct {
+		name         string
+		jpg          bool
+		sizes        []int64
+		method       ResizeMethod
+		compressions int64 // Including the upload; 0 if an error is expected.
+	}{
+		{"PNG", false, []int64{32, 16, 32}, ResizeMethodCover, 3},
+		{"JPEG", true, []int64{16, 32}, ResizeMethodThumb, 5},
+		{"no sizes", false, nil, ResizeMethodCover, 0},
+		{"scaled", false, []int64{16}, ResizeMethodScale, 0},
+	}
+	for _, tc := range iconTests {
+		var img bytes.Buffer
+		var err error
+		if tc.jpg {
+			err = jpeg.Encode(&img, image.NewNRGBA(image.Rect(0, 0, 64, 64)), nil)
+		} else {
+			err = png.Encode(&img, image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := api.Compressions()
+		source, err := FromBuffer(img.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		variants, err := source.Icons(tc.sizes, tc.method, "")
+		if tc.compressions == 0 {
+			if err == nil {
+				t.Fatalf("%s: got %d icon(s), and no error", tc.name, len(variants))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		var sizes []int64
+		for _, v := range variants {
+			if v.Result.MediaType() != "image/png" || v.Result.Width() != v.Size || v.Result.Height() != v.Size {
+				t.Fatalf("%s: got a %dx%d %s for size %d", tc.name, v.Result.Width(), v.Result.Height(), v.Result.MediaType(), v.Size)
+			}
+			sizes = append(sizes, v.Size)
+		}
+		if !slices.Equal(sizes, []int64{16, 32}) {
+			t.Fatalf("%s: got sizes %v for %v", tc.name, sizes, tc.sizes)
+		}
+		if got := api.Compressions() - before; got != tc.compressions {
+			t.Fatalf("%s: used %d compression(s), expected %d", tc.name, got, tc.compressions)
+		}
+	}
+}
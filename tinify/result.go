@@ -10,6 +10,7 @@ import (
 // Note that the metadata is its own object and handled separately.
 type Result struct {
 	data        []byte // Raw image data.
+	stats       Stats  // Sizes before and after, and how long it took.
 	*ResultMeta        // Additional metadata returned by TinyPNG, namely, the file location generated.
 }
 
@@ -26,6 +27,15 @@ func (r *Result) Data() []byte {
 	return r.data
 }
 
+// Returns the sizes of the image before and after, and how long it took to get the result.
+// Results built with NewResult have no input size, nor duration.
+func (r *Result) Stats() Stats {
+	if r.stats.OutputSize == 0 {
+		return newStats(r.stats.InputSize, int64(len(r.data)), r.stats.Duration)
+	}
+	return r.stats
+}
+
 // Retrieves the actual body of the call, which may be the raw image data.
 func (r *Result) ToBuffer() []byte {
 	return r.Data()
@@ -59,6 +69,16 @@ func (r *Result) ContentType() string {
 	return r.ResultMeta.mediaType()
 }
 
+// Returns the image width, as reported by the API in the `Image-Width` header.
+func (r *Result) Width() int64 {
+	return r.ResultMeta.width()
+}
+
+// Returns the image height, as reported by the API in the `Image-Height` header.
+func (r *Result) Height() int64 {
+	return r.ResultMeta.height()
+}
+
 // Returns the numbr of compressions made so far.
 func (r *Result) CompressionCount() int64 {
 	return r.ResultMeta.compressionCount()
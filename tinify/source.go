@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"time"
 )
 
 const (
@@ -30,6 +31,24 @@ type Source struct {
 	url              string         // URL to retrieve from.
 	commands         map[string]any // Commands passed to the Tinify API.
 	compressionCount string         // This is the number of compressions made with this API key this month; may become an integer in the future,
+	shrink           ShrinkInfo     // What the API reported about the uploaded image and its compressed version.
+	uploadTime       time.Duration  // How long the upload took.
+}
+
+// JSONified type for the description of an image, as returned by the API after an upload.
+type ImageInfo struct {
+	Size   int64   `json:"size"`             // Size, in bytes.
+	Type   string  `json:"type"`             // Media Type.
+	Width  int64   `json:"width,omitempty"`  // Only set for the output.
+	Height int64   `json:"height,omitempty"` // Only set for the output.
+	Ratio  float64 `json:"ratio,omitempty"`  // Output size / input size; only set for the output.
+	URL    string  `json:"url,omitempty"`    // Same as the Location header; only set for the output.
+}
+
+// JSONified type for the body returned by the API after an upload.
+type ShrinkInfo struct {
+	Input  ImageInfo `json:"input"`
+	Output ImageInfo `json:"output"`
 }
 
 // JSONified type for error messages from the Tinify API, if present.
@@ -60,12 +79,16 @@ func FromFile(path string) (s *Source, err error) {
 }
 
 func FromBuffer(buf []byte) (s *Source, err error) {
+	start := time.Now()
 	response, err := GetClient().Request(http.MethodPost, "/shrink", buf)
 	if err != nil {
 		return
 	}
 
 	s, err = getSourceFromResponse(response)
+	if s != nil {
+		s.uploadTime = time.Since(start)
+	}
 	return
 }
 
@@ -81,33 +104,63 @@ func FromUrl(url string) (s *Source, err error) {
 		},
 	}
 
+	start := time.Now()
 	response, err := GetClient().Request(http.MethodPost, "/shrink", body)
 	if err != nil {
 		return
 	}
 
 	s, err = getSourceFromResponse(response)
+	if s != nil {
+		s.uploadTime = time.Since(start)
+	}
 	return
 }
 
 // getSourceFromResponse tries to retrieve the URL that the Tinify API created to download the processed image.
 func getSourceFromResponse(response *http.Response) (s *Source, err error) {
-	location := response.Header["Location"]
-	url := ""
-	if len(location) > 0 && response.StatusCode < http.StatusBadRequest {
-		url = location[0]
-	} else {
-		return nil, fmt.Errorf("empty location %q and/or status error %d", location[0], response.StatusCode)
+	defer response.Body.Close()
+
+	location := response.Header.Get("Location")
+	if len(location) == 0 || response.StatusCode >= http.StatusBadRequest {
+		return nil, errorFromResponse(response)
 	}
 
-	s = newSource(url, nil)
+	s = newSource(location, nil)
 	// Get number of compressions for this API key for this month, it comes in a header of its own.
 	// If the request didn't have such a header, that's ok, it'll just be an empty sring.
 	// (gwyneth 29250713)
-	s.compressionCount = response.Header["Compression-Count"][0]
+	s.compressionCount = response.Header.Get("Compression-Count")
+	// The body describes the uploaded image. It's merely informative, so errors can be ignored.
+	json.NewDecoder(response.Body).Decode(&s.shrink)
 	return
 }
 
+// Shrink returns what the API reported about the uploaded image (input) and
+// its compressed version (output), before any other commands were applied.
+func (s *Source) Shrink() ShrinkInfo {
+	return s.shrink
+}
+
+// errorFromResponse builds an error out of a failed API call, using the
+// JSONified error message in the body, if there is one.
+func errorFromResponse(response *http.Response) error {
+	data, err := io.ReadAll(response.Body)
+	if err != nil || len(data) == 0 {
+		// we can only retrieve the Status line with a short error
+		return errors.New(response.Status)
+	}
+	var errMsg ErrorMessage
+
+	if jErr := json.Unmarshal(data, &errMsg); jErr != nil {
+		// Unmarshalling failed, but we still have the status.
+		return fmt.Errorf("Tinify API call failed, HTTP status was %q, couldn't unmarshal JSON body: error %q", response.Status, jErr)
+	}
+	// We've successfully decoded the error message, so we can return it:
+	return fmt.Errorf("Tinify API call failed, HTTP status was %q. Error: %s Message: %s",
+		response.Status, errMsg.Error, errMsg.Message)
+}
+
 // ToFile is a wrapper that grabs the content of the result and writes to a file.
 // The compression count is discarded.
 //
@@ -161,6 +214,24 @@ func (s *Source) ToBufferC() (rawData []byte, count int64, err error) {
 	return
 }
 
+// Variant returns a new source for the same uploaded image, without any of the
+// commands set on this one, so that several different versions of an image
+// can be retrieved from a single upload.
+func (s *Source) Variant() *Source {
+	v := newSource(s.url, nil)
+	v.compressionCount = s.compressionCount
+	v.shrink = s.shrink
+	v.uploadTime = s.uploadTime
+	return v
+}
+
+// Result does the actual remote API call and returns the whole result object,
+// so that the caller can inspect its metadata (width, height, media type...)
+// before deciding where to write the image data.
+func (s *Source) Result() (*Result, error) {
+	return s.toResult()
+}
+
 // Checks errors in the list of commands for a resizing operation.
 func (s *Source) Resize(option *ResizeOption) error {
 	if option == nil {
@@ -251,10 +322,12 @@ func (s *Source) toResult() (r *Result, err error) {
 		return
 	}
 
+	start := time.Now()
 	response, err := GetClient().Request(http.MethodGet, s.url, s.commands)
 	if err != nil {
 		return
 	}
+	defer response.Body.Close()
 
 	// NOTE: if the request succeeds, but the API found an error, it returns with a JSON
 	// indicating the error.
@@ -286,5 +359,6 @@ func (s *Source) toResult() (r *Result, err error) {
 
 	// No errors found. The result can be sent back to the caller.
 	r = NewResult(response.Header, data)
+	r.stats = newStats(s.shrink.Input.Size, int64(len(data)), s.uploadTime+time.Since(start))
 	return
 }
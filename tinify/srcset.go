@@ -0,0 +1,74 @@
+// Responsive image sets: several widths and file types of the same image,
+// retrieved from a single upload.
+package Tinify
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// SrcsetWidths returns the widths used by Srcset for an image of the given width:
+// those which are not larger than the original, without duplicates, or else just the
+// original width. With an unknown width (zero), all of them are used.
+func SrcsetWidths(widths []int64, original int64) []int64 {
+	var useWidths []int64
+	for _, width := range widths {
+		if original > 0 && width > original {
+			continue
+		}
+		if !slices.Contains(useWidths, width) {
+			useWidths = append(useWidths, width)
+		}
+	}
+	if len(useWidths) == 0 && original > 0 {
+		useWidths = []int64{original}
+	}
+	return useWidths
+}
+
+// One of the images in a responsive set.
+type SrcsetVariant struct {
+	Width  int64   // Requested width.
+	Type   string  // Requested file type (png, jpeg, webp, avif).
+	Result *Result // What the API returned.
+}
+
+// Srcset retrieves one variant of the image for each combination of width and
+// file type, scaling it (see ResizeMethodScale) and converting it as needed.
+// Widths larger than the original are skipped, since that would mean upscaling;
+// if all of them are, the original width is used instead.
+// Note that each variant counts as two additional compressions (resize and convert).
+func (s *Source) Srcset(widths []int64, types []string) ([]SrcsetVariant, error) {
+	if len(widths) == 0 || len(types) == 0 {
+		return nil, errors.New("srcset requires at least one width and one file type")
+	}
+
+	// The width of the original is reported by the API after the upload.
+	useWidths := SrcsetWidths(widths, s.shrink.Output.Width)
+	variants := make([]SrcsetVariant, 0, len(useWidths)*len(types))
+	for _, width := range useWidths {
+		for _, fileType := range types {
+			v := s.Variant()
+			if err := v.Resize(&ResizeOption{
+				Method: ResizeMethodScale,
+				Width:  width,
+			}); err != nil {
+				return variants, err
+			}
+			if err := v.Convert([]string{fileType}); err != nil {
+				return variants, err
+			}
+			result, err := v.toResult()
+			if err != nil {
+				return variants, fmt.Errorf("srcset variant %s at %dpx failed: %w", fileType, width, err)
+			}
+			variants = append(variants, SrcsetVariant{
+				Width:  width,
+				Type:   fileType,
+				Result: result,
+			})
+		}
+	}
+	return variants, nil
+}
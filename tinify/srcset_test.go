@@ -0,0 +1,48 @@
+// Tests for responsive image sets.
+package Tinify
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// Checks the variants retrieved for each combination of width and file type, skipping
+// widths larger than the original, and using the original width if all of them are;
+// with an unknown width, none are skipped.
+func TestSrcset(t *testing.T) {
+	useFakeAPI(t).Size = 500
+	source, err := FromBuffer([]byte("not really an image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srcsetTests = []struct {
+		widths []int64
+		types  []string
+		want   []string // Width and media type of each variant.
+	}{
+		{[]int64{320, 640}, []string{"webp", "avif"}, []string{"320 image/webp", "320 image/avif"}},
+		{[]int64{100, 200, 100}, []string{"png"}, []string{"100 image/png", "200 image/png"}},
+		{[]int64{500, 1000}, []string{"webp"}, []string{"500 image/webp"}},
+		{[]int64{640, 1280}, []string{"webp"}, []string{"500 image/webp"}},
+		{nil, []string{"webp"}, nil},
+		{[]int64{320}, nil, nil},
+	}
+	for _, tc := range srcsetTests {
+		variants, err := source.Srcset(tc.widths, tc.types)
+		if (err == nil) != (tc.want != nil) {
+			t.Fatalf("%v as %v: got error %v", tc.widths, tc.types, err)
+		}
+		var got []string
+		for _, v := range variants {
+			got = append(got, fmt.Sprintf("%d %s", v.Result.Width(), v.Result.MediaType()))
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Fatalf("%v as %v: got %q, expected %q", tc.widths, tc.types, got, tc.want)
+		}
+	}
+
+	if got := SrcsetWidths([]int64{640, 1280, 640}, 0); !slices.Equal(got, []int64{640, 1280}) {
+		t.Fatalf("with an unknown width, got widths %v, expected 640 and 1280", got)
+	}
+}
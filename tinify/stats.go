@@ -0,0 +1,53 @@
+package Tinify
+
+import "time"
+
+// Stats describes what was gained by processing an image.
+type Stats struct {
+	InputSize  int64         `json:"input_size"`  // Size of the uploaded image, in bytes.
+	OutputSize int64         `json:"output_size"` // Size of the result, in bytes.
+	Ratio      float64       `json:"ratio"`       // OutputSize / InputSize; zero if the input size is unknown.
+	Duration   time.Duration `json:"duration"`    // Time spent uploading the image and downloading the result.
+}
+
+// newStats fills in the ratio, too.
+func newStats(inputSize, outputSize int64, duration time.Duration) Stats {
+	s := Stats{
+		InputSize:  inputSize,
+		OutputSize: outputSize,
+		Duration:   duration,
+	}
+	if inputSize > 0 {
+		s.Ratio = float64(outputSize) / float64(inputSize)
+	}
+	return s
+}
+
+// Saved returns how many bytes were saved; negative if the result is larger.
+func (s Stats) Saved() int64 {
+	return s.InputSize - s.OutputSize
+}
+
+// Savings returns the bytes saved as a percentage of the input size.
+func (s Stats) Savings() float64 {
+	if s.InputSize == 0 {
+		return 0
+	}
+	return (1 - s.Ratio) * 100
+}
+
+// Threshold is the minimum gain for a result to be worth keeping instead of
+// the original; zero values are not checked.
+type Threshold struct {
+	Percent float64 // Minimum savings, as a percentage of the input size.
+	Bytes   int64   // Minimum savings, in bytes.
+}
+
+// Met reports whether the savings reach the threshold. A larger result never does,
+// unless no threshold was set at all.
+func (t Threshold) Met(s Stats) bool {
+	if t.Percent <= 0 && t.Bytes <= 0 {
+		return true
+	}
+	return s.Saved() > 0 && s.Savings() >= t.Percent && s.Saved() >= t.Bytes
+}
@@ -0,0 +1,27 @@
+// Tests for compression statistics and thresholds.
+package Tinify
+
+import "testing"
+
+// Checks which savings meet each threshold, by percentage, by bytes, or both.
+func TestThreshold(t *testing.T) {
+	var thresholdTests = []struct {
+		threshold Threshold
+		before    int64
+		after     int64
+		want      bool
+	}{
+		{Threshold{}, 1000, 1200, true},
+		{Threshold{Percent: 5}, 1000, 960, false},
+		{Threshold{Percent: 5}, 1000, 950, true},
+		{Threshold{Bytes: 100}, 1000, 950, false},
+		{Threshold{Percent: 1, Bytes: 100}, 10000, 9800, true},
+		{Threshold{Percent: 1}, 1000, 1200, false},
+	}
+	for _, tc := range thresholdTests {
+		stats := Stats{InputSize: tc.before, OutputSize: tc.after, Ratio: float64(tc.after) / float64(tc.before)}
+		if got := tc.threshold.Met(stats); got != tc.want {
+			t.Fatalf("threshold %+v on %d -> %d byte(s) gave %v, expected %v", tc.threshold, tc.before, tc.after, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package tinifytest provides a minimal stand-in for the Tinify API, for testing code
+// which uses the Tinify client without calling the real API, e.g.:
+//
+//	api := &tinifytest.API{}
+//	Tinify.SetKey("test")
+//	Tinify.GetClient().SetTransport(api)
+//	defer Tinify.GetClient().SetTransport(nil)
+package tinifytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// API is a minimal stand-in for the Tinify API, to be used as the transport of the
+// client, or as an HTTP handler: uploads are kept, and results are the uploaded images
+// themselves, reported with whatever size and type was asked for (or else, with the type
+// detected on upload, if it's an image, or PNG otherwise). Compressions are counted as
+// the API does: one for each upload, plus one for resizing and another one for
+// converting, each time a result is retrieved.
+type API struct {
+	Size int64 // Width and height of the uploaded images, as reported; 4 if not set.
+
+	mu           sync.Mutex
+	images       [][]byte
+	compressions int64
+	status       int            // If set, all requests fail with this status.
+	failTypes    map[string]int // Conversions to these media types fail with the given status.
+	backgrounds  []string       // Asked for by transforms, in order.
+}
+
+// Fail makes all requests fail with the given HTTP status, or none of them, if it's 0.
+func (a *API) Fail(status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status = status
+}
+
+// FailType makes conversions to the given media type fail with the given HTTP status.
+func (a *API) FailType(mediaType string, status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.failTypes == nil {
+		a.failTypes = make(map[string]int)
+	}
+	a.failTypes[mediaType] = status
+}
+
+// Uploads returns how many images were uploaded so far.
+func (a *API) Uploads() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.images)
+}
+
+// Compressions returns the compression count, as reported to the client.
+func (a *API) Compressions() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.compressions
+}
+
+// Backgrounds returns the background colours asked for by transforms so far, in order.
+func (a *API) Backgrounds() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.backgrounds...)
+}
+
+// RoundTrip serves the request right away, without going through the network.
+func (a *API) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+// ServeHTTP implements /shrink, and getting the results, with at most resizing, converting
+// and transforming (which just remembers the background, since it costs nothing).
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var body []byte
+	if r.Body != nil {
+		body, _ = io.ReadAll(r.Body)
+	}
+	if a.status != 0 {
+		a.fail(w, a.status)
+		return
+	}
+	size := a.Size
+	if size == 0 {
+		size = 4
+	}
+	header := w.Header()
+	switch id, isOutput := strings.CutPrefix(r.URL.Path, "/output/"); {
+	case r.Method == http.MethodPost && r.URL.Path == "/shrink":
+		if len(body) == 0 {
+			a.fail(w, http.StatusBadRequest)
+			return
+		}
+		a.images = append(a.images, body)
+		a.compressions++
+		mediaType := uploadType(body)
+		header.Set("Compression-Count", strconv.FormatInt(a.compressions, 10))
+		header.Set("Location", "https://api.tinify.com/output/"+strconv.Itoa(len(a.images)-1))
+		header.Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"input":{"size":%d,"type":%q},"output":{"size":%d,"type":%q,"width":%d,"height":%d}}`,
+			len(body), mediaType, len(body), mediaType, size, size)
+	case isOutput:
+		i, err := strconv.Atoi(id)
+		if err != nil || i < 0 || i >= len(a.images) {
+			a.fail(w, http.StatusNotFound)
+			return
+		}
+		var commands struct {
+			Resize *struct {
+				Width  int64 `json:"width"`
+				Height int64 `json:"height"`
+			} `json:"resize"`
+			Convert *struct {
+				Type string `json:"type"`
+			} `json:"convert"`
+			Transform *struct {
+				Background string `json:"background"`
+			} `json:"transform"`
+		}
+		if len(body) > 0 {
+			json.Unmarshal(body, &commands)
+		}
+		mediaType, width, height := uploadType(a.images[i]), size, size
+		if commands.Convert != nil {
+			mediaType, _, _ = strings.Cut(commands.Convert.Type, ",")
+			if status := a.failTypes[mediaType]; status != 0 {
+				a.fail(w, status)
+				return
+			}
+			a.compressions++
+		}
+		if commands.Resize != nil {
+			width, height = max(commands.Resize.Width, 1), max(commands.Resize.Height, 1)
+			a.compressions++
+		}
+		if commands.Transform != nil {
+			a.backgrounds = append(a.backgrounds, commands.Transform.Background)
+		}
+		header.Set("Compression-Count", strconv.FormatInt(a.compressions, 10))
+		header.Set("Content-Type", mediaType)
+		header.Set("Image-Width", strconv.FormatInt(width, 10))
+		header.Set("Image-Height", strconv.FormatInt(height, 10))
+		w.Write(a.images[i])
+	default:
+		a.fail(w, http.StatusNotFound)
+	}
+}
+
+// uploadType returns the media type of an uploaded image, or PNG if it's not an image.
+func uploadType(data []byte) string {
+	if mediaType := http.DetectContentType(data); strings.HasPrefix(mediaType, "image/") {
+		return mediaType
+	}
+	return "image/png"
+}
+
+// fail writes an error response, as the API does.
+func (a *API) fail(w http.ResponseWriter, status int) {
+	w.Header().Set("Compression-Count", strconv.FormatInt(a.compressions, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":%q,"message":"fake failure"}`, http.StatusText(status))
+}
@@ -0,0 +1,60 @@
+package Tinify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// KeyStatus is what the API says about an API key.
+type KeyStatus struct {
+	Valid            bool   `json:"valid"`             // The key was accepted.
+	CompressionCount int64  `json:"compression_count"` // Compressions made with this key this month, if known.
+	Error            string `json:"error,omitempty"`   // Error reported for the key or the account, if any, e.g. "Unauthorized".
+	Message          string `json:"message,omitempty"` // Explanation of the error.
+}
+
+// Validate checks the client's API key, without using up any compressions: an
+// upload without an image is always rejected, but only after the key was checked,
+// and the response still includes the compression count.
+// The returned error is only set if the API could not be asked at all; an invalid key,
+// or an account which has run out of compressions, are reported on the KeyStatus.
+// As with any other request, a fake API may be put in place with SetTransport.
+func (c *Client) Validate(ctx context.Context) (*KeyStatus, error) {
+	response, err := c.RequestContext(ctx, http.MethodPost, "/shrink", []byte{})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	status := new(KeyStatus)
+	if count := response.Header.Get("Compression-Count"); len(count) > 0 {
+		status.CompressionCount, _ = strconv.ParseInt(count, 10, 64)
+	}
+	var errMsg ErrorMessage
+	if data, err := io.ReadAll(response.Body); err == nil && len(data) > 0 {
+		json.Unmarshal(data, &errMsg)
+	}
+
+	switch response.StatusCode {
+	case http.StatusBadRequest:
+		// The expected outcome: the key is fine, the (missing) image is not.
+		status.Valid = true
+	case http.StatusUnauthorized:
+		status.Error, status.Message = errMsg.Error, errMsg.Message
+	case http.StatusTooManyRequests:
+		// The key is fine, but the account cannot make any more compressions.
+		status.Valid = true
+		status.Error, status.Message = errMsg.Error, errMsg.Message
+	default:
+		return nil, fmt.Errorf("key validation failed, HTTP status was %q. Error: %s Message: %s",
+			response.Status, errMsg.Error, errMsg.Message)
+	}
+	if len(status.Error) == 0 && !status.Valid {
+		status.Error = response.Status
+	}
+	return status, nil
+}
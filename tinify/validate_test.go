@@ -0,0 +1,40 @@
+// Tests for key validation.
+package Tinify
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// Checks how the responses of the API to an upload without an image are reported when
+// validating a key: as valid, invalid, or valid but out of compressions.
+func TestValidate(t *testing.T) {
+	api := useFakeAPI(t)
+	if _, err := FromBuffer([]byte("not really an image")); err != nil {
+		t.Fatal(err)
+	}
+
+	var validateTests = []struct {
+		status int        // Returned by the API for all requests, if set.
+		want   *KeyStatus // Nil if the validation itself fails.
+	}{
+		{0, &KeyStatus{Valid: true, CompressionCount: 1}},
+		{http.StatusUnauthorized, &KeyStatus{CompressionCount: 1, Error: "Unauthorized", Message: "fake failure"}},
+		{http.StatusTooManyRequests, &KeyStatus{Valid: true, CompressionCount: 1, Error: "Too Many Requests", Message: "fake failure"}},
+		{http.StatusServiceUnavailable, nil},
+	}
+	for _, tc := range validateTests {
+		api.Fail(tc.status)
+		got, err := GetClient().Validate(context.Background())
+		switch {
+		case tc.want == nil && err == nil:
+			t.Fatalf("HTTP %d: got %+v, expected an error", tc.status, got)
+		case tc.want != nil && (err != nil || *got != *tc.want):
+			t.Fatalf("HTTP %d: got %+v (error %v), expected %+v", tc.status, got, err, tc.want)
+		}
+	}
+	if api.Uploads() != 1 || api.Compressions() != 1 {
+		t.Fatalf("validating the key made %d upload(s) and %d compression(s)", api.Uploads()-1, api.Compressions()-1)
+	}
+}
@@ -0,0 +1,199 @@
+// Usage tracking: a local history of the compression counts returned by the API,
+// and the `usage` command, which shows where this month's count is heading.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// usageEntry is one line of the history file.
+type usageEntry struct {
+	Time             time.Time `json:"time"`
+	Key              string    `json:"key"` // Just the last few characters.
+	CompressionCount int64     `json:"compression_count"`
+	Operation        string    `json:"operation"`
+}
+
+// usageReport is what the `usage` command shows.
+type usageReport struct {
+	Key                  string       `json:"key"`
+	CompressionCount     int64        `json:"compression_count"`
+	Checked              time.Time    `json:"checked"`
+	FreeMonthlyAllowance int64        `json:"free_monthly_allowance"`
+	FreeRemaining        int64        `json:"free_remaining"`
+	ProjectedMonthEnd    int64        `json:"projected_month_end"`
+	MonthEnd             time.Time    `json:"month_end"`
+	History              []usageEntry `json:"history"`
+}
+
+// The compression count last returned by the API during this run, if it was called at all.
+var runCompressionCount int64
+
+// usageHistoryPath returns the path to the history file.
+func usageHistoryPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tinify-go", "usage-history.jsonl"), nil
+}
+
+// keySuffix returns the last few characters of the API key, which are enough to tell keys apart.
+func keySuffix() string {
+	if len(setting.Key) < 4 {
+		return setting.Key
+	}
+	return setting.Key[len(setting.Key)-4:]
+}
+
+// appendUsageHistory adds the compression count to the history file.
+func appendUsageHistory(count int64) error {
+	path, err := usageHistoryPath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	line, err := json.Marshal(usageEntry{
+		Time:             time.Now(),
+		Key:              keySuffix(),
+		CompressionCount: count,
+		Operation:        setting.Operation,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordUsage adds the compression count at the end of the run to the history, just
+// once, however many images were processed; runs which did not call the API add nothing.
+func recordUsage() {
+	if runCompressionCount == 0 {
+		return
+	}
+	if err := appendUsageHistory(runCompressionCount); err != nil {
+		setting.Logger.Debug().Msgf("recordUsage: could not update the usage history: %s", err)
+	}
+	runCompressionCount = 0
+}
+
+// readUsageHistory returns the entries of the history file for the current key, since the given time.
+func readUsageHistory(since time.Time) ([]usageEntry, error) {
+	path, err := usageHistoryPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []usageEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry usageEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // most likely a line left half-written.
+		}
+		if entry.Key == keySuffix() && !entry.Time.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// projectMonthEnd extrapolates the compression count at the end of the month, assuming
+// that images keep being compressed at the same rate as so far. Less than a day into
+// the month, there is not enough data to say anything.
+func projectMonthEnd(count int64, now time.Time) (int64, time.Time) {
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	monthEnd := monthStart.AddDate(0, 1, 0)
+	elapsed := now.Sub(monthStart)
+	if elapsed < 24*time.Hour {
+		elapsed = 24 * time.Hour
+	}
+	projected := float64(count) * float64(monthEnd.Sub(monthStart)) / float64(elapsed)
+	return int64(projected + 0.5), monthEnd.Add(-time.Second)
+}
+
+// usage is the action for the `usage` command.
+func usage(ctx context.Context, cmd *cli.Command) error {
+	setting.Operation = "usage"
+	// Validating the key is the cheapest way to get the count.
+	status, err := validateKey(ctx)
+	if err != nil {
+		return err
+	}
+	if !status.Valid {
+		return keyError(status)
+	}
+	count := status.CompressionCount
+
+	now := time.Now()
+	report := usageReport{
+		Key:                  "[..." + keySuffix() + "]",
+		CompressionCount:     count,
+		Checked:              now,
+		FreeMonthlyAllowance: freeMonthlyCompressions,
+		FreeRemaining:        max(0, freeMonthlyCompressions-count),
+	}
+	report.ProjectedMonthEnd, report.MonthEnd = projectMonthEnd(count, now)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	if report.History, err = readUsageHistory(monthStart); err != nil {
+		return err
+	}
+	if n := max(0, cmd.Int("history")); len(report.History) > n {
+		report.History = report.History[len(report.History)-n:]
+	}
+	if report.History == nil {
+		report.History = []usageEntry{}
+	}
+
+	if setting.OutputFormat == "json" || setting.OutputFormat == "ndjson" {
+		encoder := json.NewEncoder(os.Stdout)
+		if setting.OutputFormat == "json" {
+			encoder.SetIndent("", "\t")
+		}
+		return encoder.Encode(report)
+	}
+
+	fmt.Printf("API key:             %s\n", report.Key)
+	fmt.Printf("Compression count:   %d (as of %s)\n", report.CompressionCount, report.Checked.Format(time.DateTime))
+	fmt.Printf("Free this month:     %d of %d remaining\n", report.FreeRemaining, report.FreeMonthlyAllowance)
+	fmt.Printf("Projected month end: %d by %s", report.ProjectedMonthEnd, report.MonthEnd.Format(time.DateOnly))
+	if report.ProjectedMonthEnd > freeMonthlyCompressions {
+		fmt.Printf(" (%d over the free allowance)", report.ProjectedMonthEnd-freeMonthlyCompressions)
+	}
+	fmt.Println()
+	if len(report.History) > 0 {
+		fmt.Println("\nHistory this month:")
+		for _, entry := range report.History {
+			fmt.Printf("  %s  %-16s %6d\n", entry.Time.Format(time.DateTime), entry.Operation, entry.CompressionCount)
+		}
+	}
+	return nil
+}
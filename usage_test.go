@@ -0,0 +1,62 @@
+// Tests for the usage history and projections.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Checks the projection of the compression count to the end of the month.
+func TestProjectMonthEnd(t *testing.T) {
+	var projectTests = []struct {
+		count int64
+		now   time.Time
+		want  int64
+	}{
+		{100, time.Date(2025, time.April, 16, 0, 0, 0, 0, time.UTC), 200},
+		{0, time.Date(2025, time.April, 20, 0, 0, 0, 0, time.UTC), 0},
+		{31, time.Date(2025, time.January, 2, 0, 0, 0, 0, time.UTC), 961},
+		// Less than a day into the month, it counts as a whole day.
+		{10, time.Date(2025, time.April, 1, 6, 0, 0, 0, time.UTC), 300},
+	}
+
+	for _, tc := range projectTests {
+		got, monthEnd := projectMonthEnd(tc.count, tc.now)
+		if got != tc.want {
+			t.Fatalf("projected %d on %s and got %d, expected %d", tc.count, tc.now, got, tc.want)
+		}
+		if monthEnd.Month() != tc.now.Month() || monthEnd.AddDate(0, 0, 1).Day() != 1 {
+			t.Fatalf("month end for %s is %s, which is not the last day of the month", tc.now, monthEnd)
+		}
+	}
+}
+
+// Checks that the usage history gets a single entry per run, with the last compression
+// count, however many times the API was called.
+func TestRecordUsage(t *testing.T) {
+	saved := setting
+	defer func() { setting, runCompressionCount = saved, 0 }()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	setting.Key, setting.Operation = "abcdefgh", "compress"
+
+	for _, count := range []int64{11, 12, 13} {
+		if err := saveCompressionCount(count); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err := readUsageHistory(time.Time{}); err != nil || len(entries) != 0 {
+		t.Fatalf("history written before the end of the run: %+v (error: %v)", entries, err)
+	}
+	recordUsage()
+	// Nothing else was done.
+	recordUsage()
+	entries, err := readUsageHistory(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].CompressionCount != 13 || entries[0].Key != "efgh" || entries[0].Operation != "compress" {
+		t.Fatalf("expected a single entry with compression count 13, got %+v", entries)
+	}
+}
@@ -0,0 +1,78 @@
+// Several outputs from a single upload: one per file type, preset, width or icon
+// size, each of them with its own name and its own record.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// variantTemplate makes sure that, with several outputs per image, each of them gets
+// its own name. A given output template must include one of the placeholders which
+// tell them apart, or else all outputs would get the same name; otherwise, whatever
+// output filename was given (or the input filename, if none) becomes an output
+// template, by adding suffix to its name (without the extension). The operation and
+// the reason for the several outputs (e.g. "--each-type") go into the error messages.
+func variantTemplate(operation, reason, suffix string, placeholders ...string) error {
+	switch {
+	case len(setting.OutputTemplate) > 0 && len(setting.OutputFileName) == 0:
+		if !slices.ContainsFunc(placeholders, func(p string) bool { return strings.Contains(setting.OutputTemplate, p) }) {
+			return fmt.Errorf("%s: with %s, the output template must include %s, or all outputs would get the same name",
+				operation, reason, strings.Join(placeholders, " or "))
+		}
+	case setting.OutputFileName == "-" || (len(setting.OutputFileName) == 0 && (len(setting.ImageName) == 0 || setting.ImageName == "-")):
+		return fmt.Errorf("%s: with %s, the outputs cannot all be written to STDOUT; please give an output filename", operation, reason)
+	default:
+		name := setting.OutputFileName
+		if len(name) == 0 {
+			name = setting.ImageName
+		}
+		dir, base, _ := splitInputName(name)
+		setting.OutputTemplate = filepath.Join(dir, base+suffix)
+		setting.OutputFileName = ""
+	}
+	return nil
+}
+
+// eachOutput produces n outputs from the same upload, calling output for each of them,
+// which returns the compressions it used. Each output gets its own record (and pending
+// ledger entry), based on the one started by openStream, so that it's reported on its
+// own; the upload, and the placeholder (if any), are charged to the first one. Skipped
+// outputs do not stop the others. The record of the last output is left open, for the
+// action to finish it, together with whatever else the action does afterwards.
+func eachOutput(n int, output func(i int) (int64, error)) error {
+	var base record
+	if current != nil {
+		base = *current
+	}
+	var pending *ledgerEntry
+	if activeLedger != nil {
+		pending = activeLedger.pending
+	}
+	for i := range n {
+		// Set up before calling the API, so that a failure is reported for this output.
+		current = &record{}
+		*current = base
+		if pending != nil {
+			entry := *pending
+			activeLedger.pending = &entry
+		}
+		compressions, err := output(i)
+		if current != nil {
+			current.Compressions = compressions
+			if i == 0 {
+				current.Compressions++
+				if imagePlaceholder != nil {
+					current.Compressions += imagePlaceholder.compressions
+				}
+			}
+		}
+		if i == n-1 || (err != nil && !isSkipped(err)) {
+			return err
+		}
+		endRecord(err)
+	}
+	return nil
+}
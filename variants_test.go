@@ -0,0 +1,149 @@
+// Tests for several outputs from a single upload.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Checks that, with several outputs per image, each of them gets its own name, or an
+// error if that's not possible.
+func TestVariantTemplate(t *testing.T) {
+	var templateTests = []struct {
+		input, output, tmpl string
+		presets             bool   // With several presets instead of --each-type.
+		want                string // Empty if an error is expected.
+	}{
+		{"photo.png", "", "", false, "photo.{ext}"},
+		{"img/photo.png", "out/cat.webp", "", false, "out/cat.{ext}"},
+		{"photo.png", "", "out/{name}.{type}", false, "out/{name}.{type}"},
+		{"photo.png", "", "out/{name}.webp", false, ""},
+		{"photo.png", "-", "", false, ""},
+		{"", "", "", false, ""},
+		{"img/photo.png", "", "", true, "img/photo-{preset}.{ext}"},
+		{"photo.png", "", "{name}-{preset}.{ext}", true, "{name}-{preset}.{ext}"},
+		{"photo.png", "", "{name}.{ext}", true, ""},
+		{"-", "", "", true, ""},
+	}
+	saved := setting
+	defer func() { setting = saved }()
+	for _, tc := range templateTests {
+		setting.ImageName, setting.OutputFileName, setting.OutputTemplate = tc.input, tc.output, tc.tmpl
+		var err error
+		if tc.presets {
+			err = variantTemplate("resize", "several presets", "-{preset}.{ext}", "{preset}")
+		} else {
+			err = variantTemplate("convert", "--each-type", ".{ext}", "{ext}", "{type}")
+		}
+		switch {
+		case len(tc.want) == 0 && err == nil:
+			t.Fatalf("%q -> %q (template %q): expected an error, got template %q", tc.input, tc.output, tc.tmpl, setting.OutputTemplate)
+		case len(tc.want) > 0 && err != nil:
+			t.Fatalf("%q -> %q (template %q): %s", tc.input, tc.output, tc.tmpl, err)
+		case len(tc.want) > 0 && setting.OutputTemplate != filepath.FromSlash(tc.want):
+			t.Fatalf("%q -> %q (template %q): got template %q, expected %q", tc.input, tc.output, tc.tmpl, setting.OutputTemplate, tc.want)
+		}
+	}
+}
+
+// Checks that, with --each-type, the types converted before one which fails are kept,
+// written, recorded on the ledger and counted, and that the failure is reported too;
+// running it again converts just the type which failed.
+func TestConvertEach(t *testing.T) {
+	saved, savedLedger := setting, activeLedger
+	defer func() { setting, activeLedger, current, records, summaryRecords = saved, savedLedger, nil, nil, nil }()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	api := useFakeAPI(t)
+	api.FailType("image/avif", http.StatusUnsupportedMediaType)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "cat.png")
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if activeLedger, err = openLedger(filepath.Join(dir, ledgerFileName)); err != nil {
+		t.Fatal(err)
+	}
+	setting.ImageName, setting.OutputFileName, setting.OutputTemplate = input, "", ""
+	setting.EachType, setting.DryRun, setting.Force, setting.OutputFormat, setting.SummaryFormat = true, false, false, "json", "none"
+	setting.MinSavings, setting.MinSSIM, setting.Placeholder = 0, 0, ""
+
+	cmd := &cli.Command{
+		Name:   "convert",
+		Flags:  []cli.Flag{&cli.StringFlag{Name: "type", Destination: &setting.FileType}},
+		Action: withRecord(convert),
+	}
+	report := captureStdout(t, func() { err = cmd.Run(context.Background(), []string{"convert", "--type", "webp,avif"}) })
+	if err == nil {
+		t.Fatal("conversion to AVIF did not fail")
+	}
+	var recs []record
+	if err = json.Unmarshal([]byte(report), &recs); err != nil {
+		t.Fatalf("cannot read the report %q: %s", report, err)
+	}
+
+	webp := filepath.Join(dir, "cat.webp")
+	if _, err = os.Stat(webp); err != nil {
+		t.Fatalf("WebP not kept: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "cat.avif")); err == nil {
+		t.Fatal("AVIF written, although its conversion failed")
+	}
+	if _, ok := activeLedger.outputs[webp]; !ok || len(activeLedger.outputs) != 1 {
+		t.Fatalf("expected just the WebP on the ledger, got %+v", activeLedger.outputs)
+	}
+	// The upload and the WebP conversion.
+	if api.Compressions() != 2 || setting.CompressionCount != api.Compressions() {
+		t.Fatalf("compression count is %d, the API counted %d, expected 2", setting.CompressionCount, api.Compressions())
+	}
+	if count, _ := lastCompressionCount(); count != api.Compressions() {
+		t.Fatalf("saved compression count is %d, expected %d", count, api.Compressions())
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected two records, got %+v", recs)
+	}
+	if rec := recs[0]; rec.Output != webp || rec.Compressions != 2 || len(rec.Error) > 0 {
+		t.Fatalf("expected the WebP to be recorded, with 2 compressions, got %+v", rec)
+	}
+	if rec := recs[1]; len(rec.Error) == 0 || rec.Compressions != 0 {
+		t.Fatalf("expected the AVIF to be recorded as failed, got %+v", rec)
+	}
+
+	// Once AVIF works, running it again just converts to AVIF, and the ledger keeps track
+	// of both types, so that a third run does not even upload the image.
+	api.FailType("image/avif", 0)
+	for run, want := range []int64{4, 4} {
+		setting.OutputTemplate = ""
+		if activeLedger, err = openLedger(filepath.Join(dir, ledgerFileName)); err != nil {
+			t.Fatal(err)
+		}
+		captureStdout(t, func() { err = cmd.Run(context.Background(), []string{"convert", "--type", "webp,avif"}) })
+		if err != nil {
+			t.Fatalf("run %d: %s", run+2, err)
+		}
+		if api.Compressions() != want {
+			t.Fatalf("run %d: the API counted %d compressions, expected %d", run+2, api.Compressions(), want)
+		}
+		if len(activeLedger.outputs) != 2 {
+			t.Fatalf("run %d: expected both types on the ledger, got %+v", run+2, activeLedger.outputs)
+		}
+	}
+	if api.Uploads() != 2 {
+		t.Fatalf("image uploaded %d times, expected 2", api.Uploads())
+	}
+}
@@ -0,0 +1,262 @@
+// Watch mode: monitors a directory tree and runs new or changed images through
+// the API, without anyone having to invoke the CLI for each file.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/urfave/cli/v3"
+)
+
+// Filename extensions of the images that the watcher cares about.
+var watchExtensions = []string{".png", ".jpg", ".jpeg", ".webp", ".avif"}
+
+// watch is the action for the `watch` command. It runs until interrupted.
+func watch(ctx context.Context, cmd *cli.Command) error {
+	var err error // declared here due to scope issues.
+
+	if len(setting.WatchDir) == 0 {
+		return fmt.Errorf("watch: no directory to watch")
+	}
+	if setting.InPlace && len(setting.MirrorDir) > 0 {
+		return fmt.Errorf("watch: --in-place and --mirror cannot be used together")
+	}
+	if setting.InPlace && setting.Operation == "convert" {
+		return fmt.Errorf("watch: cannot convert images in place, since their file type would change")
+	}
+	if err = checkOperation(setting.Operation, &setting); err != nil {
+		return err
+	}
+	if setting.WatchDir, err = filepath.Abs(setting.WatchDir); err != nil {
+		return err
+	}
+	if len(setting.MirrorDir) > 0 {
+		if setting.MirrorDir, err = filepath.Abs(setting.MirrorDir); err != nil {
+			return err
+		}
+	}
+
+	// Unless told otherwise, the ledger is kept at the root of the watched tree.
+	if activeLedger == nil {
+		if activeLedger, err = openLedger(filepath.Join(setting.WatchDir, ledgerFileName)); err != nil {
+			return err
+		}
+	}
+
+	// Whatever was processed so far gets reported, even if we're interrupted.
+	defer printReports()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch: cannot start watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// Files are queued for processing once no writes have been seen for a while.
+	pending := newDebouncer(setting.Debounce)
+
+	// Add the whole tree to the watcher, and catch up with whatever changed while
+	// we weren't running.
+	if err = filepath.WalkDir(setting.WatchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if isWatchIgnoredDir(path) {
+				return filepath.SkipDir
+			}
+			return watcher.Add(path)
+		}
+		if isWatchCandidate(path) {
+			if setting.DryRun {
+				// No point in waiting for anything, since nothing is going to be written;
+				// as when watching, a file which cannot be processed does not stop the others.
+				err := watchProcess(ctx, cmd, path)
+				if err != nil && !isSkipped(err) {
+					setting.Logger.Error().Msgf("watch: processing %q failed: %s", path, err)
+				}
+				endRecord(err)
+				return nil
+			}
+			pending.add(path)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("watch: cannot watch %q: %w", setting.WatchDir, err)
+	}
+
+	// In dry-run mode, just show what would be done right now.
+	if setting.DryRun {
+		return nil
+	}
+
+	setting.Logger.Info().Msgf("watch: watching %q, operation %q", setting.WatchDir, setting.Operation)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Interrupted; the deferred reports are written on the way out.
+			setting.Logger.Info().Msgf("watch: stopped watching %q", setting.WatchDir)
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			// New subdirectories need to be watched as well.
+			if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+				if !isWatchIgnoredDir(event.Name) {
+					if err := watcher.Add(event.Name); err != nil {
+						setting.Logger.Error().Msgf("watch: cannot watch new directory %q: %s", event.Name, err)
+					}
+				}
+				continue
+			}
+			if isWatchCandidate(event.Name) {
+				pending.add(event.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			setting.Logger.Error().Msgf("watch: %s", err)
+		case path := <-pending.queue:
+			// Processing happens here, one file at a time, since it relies on the globals.
+			err := watchProcess(ctx, cmd, path)
+			if err != nil && !isSkipped(err) {
+				setting.Logger.Error().Msgf("watch: processing %q failed: %s", path, err)
+			}
+			endRecord(err)
+		}
+	}
+}
+
+// isWatchCandidate checks if a file looks like an image we ought to process.
+func isWatchCandidate(path string) bool {
+	base := filepath.Base(path)
+	// Skip hidden files, which include our own temporary files and the ledger.
+	if strings.HasPrefix(base, ".") {
+		return false
+	}
+	return slices.Contains(watchExtensions, strings.ToLower(filepath.Ext(base)))
+}
+
+// isWatchIgnoredDir checks if a directory should not be watched, namely, the
+// mirror tree (if it's inside the watched tree) and hidden directories.
+func isWatchIgnoredDir(path string) bool {
+	if len(setting.MirrorDir) > 0 && (path == setting.MirrorDir || strings.HasPrefix(path, setting.MirrorDir+string(filepath.Separator))) {
+		return true
+	}
+	return path != setting.WatchDir && strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// debouncer queues each path once no new events have been seen for it for a while,
+// so that files are not processed while they're still being written.
+type debouncer struct {
+	delay  time.Duration
+	queue  chan string
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// newDebouncer returns a debouncer which waits for delay before queueing each path.
+func newDebouncer(delay time.Duration) *debouncer {
+	return &debouncer{
+		delay:  delay,
+		queue:  make(chan string, 64),
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// add (re)starts the wait for path. If it was queued already, it gets queued again,
+// since it changed after that.
+func (d *debouncer) add(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.timers[path]; ok && t.Stop() {
+		t.Reset(d.delay)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		if d.timers[path] == t {
+			delete(d.timers, path)
+		}
+		d.mu.Unlock()
+		d.queue <- path
+	})
+	d.timers[path] = t
+}
+
+// watchOutput works out where the output for path goes, as either an output filename
+// or an output template, without touching the ones given on the command line.
+func watchOutput(path string) (output, template string, err error) {
+	template = setting.OutputTemplate
+	switch {
+	case setting.InPlace:
+		output = path
+	case len(setting.MirrorDir) > 0:
+		rel, err := filepath.Rel(setting.WatchDir, filepath.Dir(path))
+		if err != nil {
+			return "", "", err
+		}
+		outputDir := filepath.Join(setting.MirrorDir, rel)
+		if err = os.MkdirAll(outputDir, 0755); err != nil {
+			return "", "", err
+		}
+		output = filepath.Join(outputDir, filepath.Base(path))
+	case len(template) == 0:
+		// No template given; add a suffix so that the original is kept.
+		template = "{dir}/{name}.tiny.{ext}"
+	}
+	// When converting, the extension of the original will most likely be wrong.
+	if len(output) > 0 && setting.Operation == "convert" {
+		dir, name, _ := splitInputName(output)
+		output, template = "", filepath.Join(dir, name+".{ext}")
+	}
+	return output, template, nil
+}
+
+// watchProcess runs a single file through the API, unless the ledger says
+// it has been processed before, or that it's one of our own outputs.
+func watchProcess(ctx context.Context, cmd *cli.Command, path string) error {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		// Gone before we got a chance to look at it.
+		return nil
+	}
+	output, template, err := watchOutput(path)
+	if err != nil {
+		return err
+	}
+	// The template is only meant for this file; the next one starts from the original.
+	saved := setting.OutputTemplate
+	defer func() { setting.OutputTemplate = saved }()
+	setting.ImageName, setting.OutputFileName, setting.OutputTemplate = path, output, template
+
+	setting.Logger.Debug().Msgf("watch: checking %q", path)
+
+	ctx, source, err := openStream(ctx)
+	if errors.Is(err, errDryRun) || isSkipped(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	setting.Logger.Info().Msgf("watch: processing %q", path)
+	if err = applyOperation(source, setting.Operation, &setting, originalImage); err != nil {
+		return err
+	}
+	return callAPI(ctx, cmd, source)
+}
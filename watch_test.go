@@ -0,0 +1,189 @@
+// Tests for `watch`.
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Checks that paths are only queued once writes to them have settled down, and
+// just once for a burst of writes.
+func TestDebouncer(t *testing.T) {
+	d := newDebouncer(50 * time.Millisecond)
+	for range 5 {
+		d.add("a.png")
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.add("b.png")
+
+	var queued []string
+	timeout := time.After(300 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case path := <-d.queue:
+			queued = append(queued, path)
+		case <-timeout:
+			waiting = false
+		}
+	}
+	if !slices.Equal(queued, []string{"a.png", "b.png"}) {
+		t.Fatalf("queued %q, expected a.png and b.png once each", queued)
+	}
+
+	// Changed after being queued, so it's queued again.
+	d.add("a.png")
+	select {
+	case path := <-d.queue:
+		if path != "a.png" {
+			t.Fatalf("queued %q, expected a.png", path)
+		}
+	case <-time.After(300 * time.Millisecond):
+		t.Fatalf("a.png was not queued again")
+	}
+}
+
+// Checks where watched files are written to, and that the output template given on
+// the command line is left as it was.
+func TestWatchOutput(t *testing.T) {
+	saved := setting
+	defer func() { setting = saved }()
+	dir := t.TempDir()
+	setting.WatchDir, setting.InPlace = filepath.Join(dir, "in"), false
+
+	var outputTests = []struct {
+		operation, template, mirror string
+		inPlace                     bool
+		output, wantTemplate        string
+	}{
+		{"compress", "", "", false, "", "{dir}/{name}.tiny.{ext}"},
+		{"compress", "{dir}/{name}.min.{ext}", "", false, "", "{dir}/{name}.min.{ext}"},
+		{"compress", "", "", true, filepath.Join(dir, "in/sub/cat.png"), ""},
+		{"compress", "", filepath.Join(dir, "out"), false, filepath.Join(dir, "out/sub/cat.png"), ""},
+		{"convert", "", filepath.Join(dir, "out"), false, "", filepath.Join(dir, "out/sub/cat.{ext}")},
+	}
+	for _, tc := range outputTests {
+		setting.Operation, setting.OutputTemplate, setting.MirrorDir, setting.InPlace = tc.operation, tc.template, tc.mirror, tc.inPlace
+		output, template, err := watchOutput(filepath.Join(dir, "in/sub/cat.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != tc.output || template != tc.wantTemplate {
+			t.Fatalf("%s with template %q, mirror %q: got (%q, %q), expected (%q, %q)", tc.operation, tc.template, tc.mirror, output, template, tc.output, tc.wantTemplate)
+		}
+		if setting.OutputTemplate != tc.template {
+			t.Fatalf("%s: output template changed to %q", tc.operation, setting.OutputTemplate)
+		}
+	}
+}
+
+// Checks that the watcher leaves alone its own outputs, whether they're known to the
+// ledger or carry our marker, without calling the API, and that it ignores hidden
+// files and the mirror tree.
+func TestWatchSkipsOwnOutputs(t *testing.T) {
+	saved, savedLedger := setting, activeLedger
+	defer func() { setting, activeLedger, current, summaryRecords = saved, savedLedger, nil, nil }()
+	dir := t.TempDir()
+	setting.WatchDir, setting.Operation, setting.OutputTemplate, setting.DryRun, setting.Force = dir, "compress", "", false, false
+	setting.OutputFormat, setting.MirrorDir, setting.InPlace = "", "", false
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "cat.tiny.png")
+	if err := os.WriteFile(output, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	marked, err := addMarker(buf.Bytes(), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "dog.png"), marked, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if activeLedger, err = openLedger(filepath.Join(dir, ledgerFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err = activeLedger.check(filepath.Join(dir, "cat.png"), []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	if err = activeLedger.record(output, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// No API key is set, so anything which got as far as the API would fail.
+	for _, name := range []string{"cat.tiny.png", "dog.png"} {
+		if err = watchProcess(context.Background(), &cli.Command{Name: "compress"}, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%s: not skipped, got %v", name, err)
+		}
+		if setting.OutputTemplate != "" {
+			t.Fatalf("%s: output template changed to %q", name, setting.OutputTemplate)
+		}
+	}
+	// Outputs known to the ledger are not even worth reporting; marked images are.
+	if len(summaryRecords) != 1 || !strings.HasSuffix(summaryRecords[0].Input, "dog.png") || len(summaryRecords[0].Skipped) == 0 {
+		t.Fatalf("expected just dog.png to be reported as skipped, got %+v", summaryRecords)
+	}
+
+	var candidateTests = []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join(dir, "cat.PNG"), true},
+		{filepath.Join(dir, "cat.gif"), false},
+		{filepath.Join(dir, ".cat.png.tmp123"), false},
+		{filepath.Join(dir, ledgerFileName), false},
+	}
+	for _, tc := range candidateTests {
+		if got := isWatchCandidate(tc.path); got != tc.want {
+			t.Fatalf("%q: candidate is %t, expected %t", tc.path, got, tc.want)
+		}
+	}
+	setting.MirrorDir = filepath.Join(dir, "out")
+	for path, want := range map[string]bool{dir: false, setting.MirrorDir: true, filepath.Join(setting.MirrorDir, "sub"): true, filepath.Join(dir, ".git"): true, filepath.Join(dir, "outside"): false} {
+		if got := isWatchIgnoredDir(path); got != want {
+			t.Fatalf("%q: ignored is %t, expected %t", path, got, want)
+		}
+	}
+}
+
+// Checks that, on a dry run, a file which cannot be processed does not stop the others
+// from being planned.
+func TestWatchDryRun(t *testing.T) {
+	saved, savedLedger := setting, activeLedger
+	defer func() {
+		setting, activeLedger, plannedItems, current, records, summaryRecords = saved, savedLedger, nil, nil, nil, nil
+	}()
+	dir := t.TempDir()
+	setting.WatchDir, setting.Operation, setting.OutputTemplate, setting.DryRun, setting.Force = dir, "compress", "", true, false
+	setting.OutputFormat, setting.MirrorDir, setting.InPlace, setting.SummaryFormat = "", "", false, "none"
+	activeLedger = nil
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"a-broken.png": []byte("not really an image"), "b-cat.png": buf.Bytes()} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var err error
+	captureStdout(t, func() { err = watch(context.Background(), &cli.Command{Name: "watch"}) })
+	if err != nil {
+		t.Fatalf("watch stopped: %s", err)
+	}
+	if len(plannedItems) != 1 || !strings.HasSuffix(plannedItems[0].Input, "b-cat.png") {
+		t.Fatalf("expected just b-cat.png to be planned, got %+v", plannedItems)
+	}
+}